@@ -4,15 +4,29 @@ import (
 	"fmt"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/user"
 	"strconv"
 	"strings"
-	"time"
+)
+
+const (
+	DEFAULT_BASTION_KEY = ""
+
+	AUTH_KEY   = "key"
+	AUTH_AGENT = "agent"
+
+	HOST_KEY_CHECK_STRICT = "strict"
+	HOST_KEY_CHECK_TOFU   = "tofu"
 )
 
 var (
-	DEFAULT_FORWARDING_TIMEOUT = time.Second * 5
+	DEFAULT_KNOWN_HOSTS_PATH = "~/.ssh/known_hosts"
+
+	// remote direction defaults
+	DEFAULT_REMOTE_BIND_ADDRESS = "localhost"
+	DEFAULT_LOCAL_TARGET        = "localhost"
 )
 
 func GetMoguraDir() string {
@@ -24,27 +38,222 @@ func GetDefaultConfigPath() string {
 }
 
 type Config struct {
-	Bastion SSHConfig      `bastion_ssh_config`
-	Tunnels []TunnelConfig `yaml:"tunnels"`
+	// default bastion for tunnels that do not specify bastion.
+	Bastion SSHConfig `yaml:"bastion_ssh_config"`
+	// named bastions, tunnel selects it with bastion key.
+	Bastions map[string]SSHConfig `yaml:"bastions"`
+	Tunnels  []TunnelConfig       `yaml:"tunnels"`
+
+	// control API unix socket path. default ~/.mogura/mogura.sock
+	ControlSocket string `yaml:"control_socket"`
+
+	// reload config when the file is changed. SIGHUP reloads without this.
+	WatchConfig bool `yaml:"watch_config"`
+
+	// log_format: text or json. empty is default log style.
+	LogFormat string `yaml:"log_format"`
+	// log_level: debug, info(default), warn or error
+	LogLevel string `yaml:"log_level"`
+
+	// retry settings for tunnel starting and ssh reconnection
+	Reconnect ReconnectConfig `yaml:"reconnect"`
+
+	// re-resolution of SRV target.
+	Resolve ResolveConfig `yaml:"resolve"`
+
+	// write target hostnames of tunnels to hosts file, and remove them when stopped.
+	ManageHosts bool `yaml:"manage_hosts"`
+	// default /etc/hosts
+	HostsFile string `yaml:"hosts_file"`
+
+	// DNS server for tunnel names (ex. orders.mogura.local). empty listen is disabled.
+	LocalDNS LocalDNSConfig `yaml:"local_dns"`
+
+	// Prometheus metrics listen address (ex. localhost:9100). empty is disabled.
+	MetricsListen string `yaml:"metrics_listen"`
+}
+
+// ReconnectConfig is exponential backoff settings. empty is default.
+type ReconnectConfig struct {
+	InitialInterval string  `yaml:"initial_interval"`
+	MaxInterval     string  `yaml:"max_interval"`
+	Multiplier      float64 `yaml:"multiplier"`
+	Jitter          float64 `yaml:"jitter"`
+	// 0 is unlimited
+	MaxAttempts int `yaml:"max_attempts"`
+}
+
+type LocalDNSConfig struct {
+	// ex. 127.0.0.1:5353
+	Listen string `yaml:"listen"`
+	// default mogura.local
+	Domain string `yaml:"domain"`
+}
+
+// ResolveConfig is range of re-resolution interval. records TTL is clamped in this range. empty is default.
+type ResolveConfig struct {
+	MinInterval string `yaml:"min_interval"`
+	MaxInterval string `yaml:"max_interval"`
+}
+
+// GetControlSocketPath returns control socket path with default.
+func (c *Config) GetControlSocketPath() string {
+	if c.ControlSocket == "" {
+		return GetDefaultControlSocketPath()
+	}
+
+	path, err := ResolveUserHome(c.ControlSocket)
+	if err != nil {
+		return c.ControlSocket
+	}
+
+	return path
+}
+
+// DefaultBastion returns bastion key for tunnels that do not specify bastion.
+// bastion_ssh_config is default, or the only one in bastions.
+func (c *Config) DefaultBastion() (string, error) {
+	if c.Bastion.Host != "" || c.Bastion.SSHConfigHost != "" {
+		return DEFAULT_BASTION_KEY, nil
+	}
+
+	if len(c.Bastions) == 1 {
+		for key := range c.Bastions {
+			return key, nil
+		}
+	}
+
+	return "", fmt.Errorf("bastion is not specified and bastion_ssh_config is not set")
+}
+
+// BastionSSHConfigs returns all bastion settings by key. bastion_ssh_config is DEFAULT_BASTION_KEY.
+func (c *Config) BastionSSHConfigs() map[string]SSHConfig {
+	configs := make(map[string]SSHConfig, len(c.Bastions)+1)
+	if c.Bastion.Host != "" || c.Bastion.SSHConfigHost != "" {
+		configs[DEFAULT_BASTION_KEY] = c.Bastion
+	}
+
+	for key, b := range c.Bastions {
+		// default display name is the key
+		if b.Name == "" {
+			b.Name = key
+		}
+		configs[key] = b
+	}
+
+	return configs
 }
 
 type SSHConfig struct {
-	Name      string `yaml:"name"`
-	Host      string `yaml:"host"`
-	Port      int    `yaml:"port"`
-	User      string `yaml:"user"`
-	KeyPath   string `yaml:"key_path"`
-	RemoteDNS string `yaml:"remote_dns"`
+	Name    string `yaml:"name"`
+	Host    string `yaml:"host"`
+	Port    int    `yaml:"port"`
+	User    string `yaml:"user"`
+	KeyPath string `yaml:"key_path"`
+
+	// resolvers in the bastion network. string or list, tried in order.
+	RemoteDNS StringList `yaml:"remote_dns"`
+	// "tcp"(default) or "udp". udp needs helper in the bastion.
+	RemoteDNSProtocol string `yaml:"remote_dns_protocol"`
+	// duration format. default 2s
+	RemoteDNSTimeout string `yaml:"remote_dns_timeout"`
+	// EDNS0 UDP buffer size. default 1232
+	RemoteDNSUDPSize int `yaml:"remote_dns_udp_size"`
+	// command in the bastion that relays stdin/stdout to UDP (%s is resolver), or "unix:/path/to/socket".
+	RemoteDNSUDPHelper string `yaml:"remote_dns_udp_helper"`
+
+	// authentication. "key"(default) or "agent"
+	Auth        string `yaml:"auth"`
+	AgentTryAll bool   `yaml:"agent_try_all"`
+
+	// host key verification
+	KnownHosts   string `yaml:"known_hosts"`
+	HostKeyCheck string `yaml:"host_key_check"`
+
+	// jump hosts to reach bastion, connect in order.
+	Jump []JumpConfig `yaml:"jump"`
+
+	// send keepalive request with this interval (ex. 30s). empty is disabled.
+	KeepaliveInterval string `yaml:"keepalive_interval"`
+	// reconnect when keepalive replies are missed this count. default 3
+	KeepaliveCountMax int `yaml:"keepalive_count_max"`
+
+	// read settings from Host block in ssh config. values in mogura config take precedence.
+	SSHConfigHost string `yaml:"ssh_config_host"`
+	SSHConfigFile string `yaml:"ssh_config_file"`
+}
+
+// StringList is a string or list of string in yaml.
+type StringList []string
+
+func (l *StringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single string
+	if err := unmarshal(&single); err == nil {
+		if single == "" {
+			*l = nil
+		} else {
+			*l = StringList{single}
+		}
+		return nil
+	}
+
+	var list []string
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*l = list
+
+	return nil
+}
+
+// JumpConfig is jump host (ProxyJump) setting.
+// empty user, key_path and auth are same as bastion.
+type JumpConfig struct {
+	Host    string `yaml:"host"`
+	Port    int    `yaml:"port"`
+	User    string `yaml:"user"`
+	KeyPath string `yaml:"key_path"`
+	Auth    string `yaml:"auth"`
 }
 
 type TunnelConfig struct {
 	Name          string `yaml:"name"`
+	Bastion       string `yaml:"bastion"`
+	Type          string `yaml:"type"`
+	Direction     string `yaml:"direction"`
 	LocalBindPort int    `yaml:"local_bind_port"`
 	TargetType    string `yaml:"target_type"`
 	Target        string `yaml:"target"`
 	TargetPort    int    `yaml:"target_port"`
+	// local listening IP address (ex. 127.0.0.2). "auto" assigns 127.0.0.x for the tunnel. default is localhost
+	LocalBindAddress string `yaml:"local_bind_address"`
+	// listen local unix domain socket instead of local_bind_port.
+	LocalBindSocket string `yaml:"local_bind_socket"`
+	// unix domain socket path in the bastion instead of target (ex. /var/run/docker.sock).
+	// in direction remote, it is local socket path.
+	TargetSocket string `yaml:"target_socket"`
+	// v4(default), v6 or any for resolving the target. local bind address is not affected.
+	IPFamily string `yaml:"ip_family"`
+	// SRV target only. spread connections over SRV targets by priority and weight.
+	LoadBalance bool `yaml:"load_balance"`
+	// SRV target only. fixed re-resolution interval instead of records TTL. duration format.
+	ResolveInterval string `yaml:"resolve_interval"`
 
+	// connection limits. duration format, empty is no limit.
+	IdleTimeout string `yaml:"idle_timeout"`
+	MaxLifetime string `yaml:"max_lifetime"`
+
+	// Deprecated: absolute timeout, it is same as max_lifetime.
 	ForwardingTimeout string `yaml:"forwarding_timeout"`
+
+	// direction remote settings. listen in the bastion, and forward to local target.
+	RemoteBindAddress string `yaml:"remote_bind_address"`
+	RemoteBindPort    int    `yaml:"remote_bind_port"`
+
+	// type socks5 settings
+	Socks5Username  string `yaml:"socks5_username"`
+	Socks5Password  string `yaml:"socks5_password"`
+	Socks5RemoteDNS bool   `yaml:"socks5_remote_dns"`
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -54,9 +263,99 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, err
 	}
 
+	err = c.Bastion.ApplySSHConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	for key, b := range c.Bastions {
+		err := b.ApplySSHConfig()
+		if err != nil {
+			return nil, fmt.Errorf("bastion %s: %v", key, err)
+		}
+		c.Bastions[key] = b
+	}
+
 	return c, nil
 }
 
+// ApplySSHConfig fills empty settings with ssh config Host block that is specified by ssh_config_host.
+func (s *SSHConfig) ApplySSHConfig() error {
+	if s.SSHConfigHost == "" {
+		return nil
+	}
+
+	path := s.SSHConfigFile
+	if path == "" {
+		path = DEFAULT_SSH_CONFIG_PATH
+	}
+
+	rPath, err := ResolveUserHome(path)
+	if err != nil {
+		return fmt.Errorf("can not resolved user home path in %s: %v", path, err)
+	}
+
+	f, err := LoadSSHConfig(rPath)
+	if err != nil {
+		return fmt.Errorf("can not load ssh config %s: %v", rPath, err)
+	}
+
+	h := f.Lookup(s.SSHConfigHost)
+	if s.Name == "" {
+		s.Name = s.SSHConfigHost
+	}
+	if s.Host == "" {
+		s.Host = h.HostName
+		if s.Host == "" {
+			// alias is real host name
+			s.Host = s.SSHConfigHost
+		}
+	}
+	if s.Port == 0 {
+		s.Port = h.Port
+	}
+	if s.User == "" {
+		s.User = h.User
+	}
+	if s.KeyPath == "" {
+		s.KeyPath = h.IdentityFile
+	}
+	if s.KnownHosts == "" {
+		s.KnownHosts = h.UserKnownHostsFile
+	}
+	if s.KeepaliveInterval == "" && h.ServerAliveInterval > 0 {
+		s.KeepaliveInterval = strconv.Itoa(h.ServerAliveInterval) + "s"
+	}
+	if s.KeepaliveCountMax == 0 {
+		s.KeepaliveCountMax = h.ServerAliveCountMax
+	}
+
+	if len(s.Jump) == 0 {
+		jumps, err := ParseProxyJump(h.ProxyJump)
+		if err != nil {
+			return fmt.Errorf("ssh config host %s: %v", s.SSHConfigHost, err)
+		}
+
+		// jump host is also alias in ssh config.
+		for i, j := range jumps {
+			jh := f.Lookup(j.Host)
+			if jh.HostName != "" {
+				jumps[i].Host = jh.HostName
+			}
+			if j.User == "" {
+				jumps[i].User = jh.User
+			}
+			if j.Port == 0 {
+				jumps[i].Port = jh.Port
+			}
+			jumps[i].KeyPath = jh.IdentityFile
+		}
+		s.Jump = jumps
+	}
+
+	return nil
+}
+
 func LoadFromYamlFile(filePath string, p interface{}) error {
 	file, err := os.Open(filePath)
 	if err != nil {
@@ -73,10 +372,10 @@ func LoadFromYamlFile(filePath string, p interface{}) error {
 }
 
 func hostport(host string, port int) string {
-	return host + ":" + strconv.Itoa(port)
+	return net.JoinHostPort(host, strconv.Itoa(port))
 }
 func localport(port int) string {
-	return "localhost:" + strconv.Itoa(port)
+	return hostport("localhost", port)
 }
 
 func ResolveUserHome(path string) (string, error) {
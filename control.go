@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/reiki4040/mogura/mogura"
+)
+
+const (
+	CONTROL_SOCKET_FILE = "mogura.sock"
+
+	// host name is not used in unix socket, but http request needs it.
+	controlBaseURL = "http://mogura"
+
+	controlClientTimeout = 10 * time.Second
+)
+
+func GetDefaultControlSocketPath() string {
+	return GetMoguraDir() + string(os.PathSeparator) + CONTROL_SOCKET_FILE
+}
+
+// TunnelStatus is tunnel state in control API.
+type TunnelStatus struct {
+	Tunnel string `json:"tunnel"`
+	// TUNNEL_STATE_UP or TUNNEL_STATE_DOWN
+	State string `json:"state"`
+	mogura.Stats
+}
+
+// TunnelController is operations for control API.
+type TunnelController interface {
+	Statuses() []TunnelStatus
+	Events() []Event
+	Up(name string) error
+	Down(name string) error
+	Restart(name string) error
+}
+
+// ControlServer is local control API on unix socket. it serves JSON over http.
+type ControlServer struct {
+	path     string
+	listener net.Listener
+	server   *http.Server
+}
+
+// StartControlServer listens unix socket and serves control API.
+func StartControlServer(path string, controller TunnelController) (*ControlServer, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, fmt.Errorf("can not create control socket dir: %v", err)
+	}
+
+	err = removeStaleSocket(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the user can control mogura.
+	l, err := listenPrivateSocket(path)
+	if err != nil {
+		return nil, fmt.Errorf("can not listen control socket %s: %v", path, err)
+	}
+
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		l.Close()
+		return nil, fmt.Errorf("can not change control socket permission: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		writeControlJSON(w, http.StatusOK, controller.Statuses())
+	})
+	mux.HandleFunc("GET /events", func(w http.ResponseWriter, r *http.Request) {
+		writeControlJSON(w, http.StatusOK, controller.Events())
+	})
+	mux.HandleFunc("POST /tunnels/{name}/up", tunnelHandler(controller.Up))
+	mux.HandleFunc("POST /tunnels/{name}/down", tunnelHandler(controller.Down))
+	mux.HandleFunc("POST /tunnels/{name}/restart", tunnelHandler(controller.Restart))
+
+	cs := &ControlServer{
+		path:     path,
+		listener: l,
+		server:   &http.Server{Handler: mux},
+	}
+
+	go cs.server.Serve(l)
+
+	return cs, nil
+}
+
+func (cs *ControlServer) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := cs.server.Shutdown(ctx)
+	os.Remove(cs.path)
+
+	return err
+}
+
+// removeStaleSocket removes socket file that is left by crashed mogura.
+// if other mogura is running with the socket, then returns error.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// do not remove other file by wrong setting.
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("control socket %s already exists and it is not socket.", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("control socket %s is in use. other mogura is running?", path)
+	}
+
+	return os.Remove(path)
+}
+
+// tunnelHandler calls operation for the tunnel in path.
+func tunnelHandler(operation func(name string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		err := operation(name)
+		if err != nil {
+			status := http.StatusConflict
+			if errors.Is(err, ErrTunnelNotFound) {
+				status = http.StatusNotFound
+			}
+			writeControlError(w, status, err)
+			return
+		}
+
+		writeControlJSON(w, http.StatusOK, controlResultResponse{Tunnel: name})
+	}
+}
+
+type controlResultResponse struct {
+	Tunnel string `json:"tunnel"`
+}
+
+type controlErrorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeControlJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeControlError(w http.ResponseWriter, status int, err error) {
+	writeControlJSON(w, status, controlErrorResponse{Error: err.Error()})
+}
+
+// ControlClient requests to running mogura via control socket.
+type ControlClient struct {
+	client *http.Client
+}
+
+func NewControlClient(path string) *ControlClient {
+	return &ControlClient{
+		client: &http.Client{
+			Timeout: controlClientTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", path)
+				},
+			},
+		},
+	}
+}
+
+func (cc *ControlClient) Status() ([]TunnelStatus, error) {
+	resp, err := cc.client.Get(controlBaseURL + "/status")
+	if err != nil {
+		return nil, fmt.Errorf("can not connect mogura. is mogura running? %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeControlError(resp)
+	}
+
+	statuses := make([]TunnelStatus, 0)
+	err = json.NewDecoder(resp.Body).Decode(&statuses)
+	if err != nil {
+		return nil, fmt.Errorf("invalid status response: %v", err)
+	}
+
+	return statuses, nil
+}
+
+func (cc *ControlClient) Events() ([]Event, error) {
+	resp, err := cc.client.Get(controlBaseURL + "/events")
+	if err != nil {
+		return nil, fmt.Errorf("can not connect mogura. is mogura running? %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeControlError(resp)
+	}
+
+	events := make([]Event, 0)
+	err = json.NewDecoder(resp.Body).Decode(&events)
+	if err != nil {
+		return nil, fmt.Errorf("invalid events response: %v", err)
+	}
+
+	return events, nil
+}
+
+// Tunnel requests operation (up, down or restart) for the tunnel.
+func (cc *ControlClient) Tunnel(name, operation string) error {
+	resp, err := cc.client.Post(controlBaseURL+"/tunnels/"+url.PathEscape(name)+"/"+operation, "application/json", nil)
+	if err != nil {
+		return fmt.Errorf("can not connect mogura. is mogura running? %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return decodeControlError(resp)
+	}
+
+	return nil
+}
+
+func decodeControlError(resp *http.Response) error {
+	e := controlErrorResponse{}
+	err := json.NewDecoder(resp.Body).Decode(&e)
+	if err != nil || e.Error == "" {
+		return fmt.Errorf("control request failed: %s", resp.Status)
+	}
+
+	return fmt.Errorf("%s", e.Error)
+}
+
+// runStatus prints tunnels status table of running mogura.
+func runStatus(socketPath string) error {
+	statuses, err := NewControlClient(socketPath).Status()
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Tunnel < statuses[j].Tunnel
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TUNNEL\tSTATE\tBASTION\tCONNECTED\tREMOTE\tACTIVE\tTOTAL\tSENT\tRECEIVED\tLAST ERROR")
+	for _, s := range statuses {
+		remote := s.DetectedRemote
+		if remote == "" {
+			remote = "-"
+		}
+
+		lastError := "-"
+		if s.LastError != "" {
+			lastError = s.LastErrorAt.Format("15:04:05") + " " + strings.ReplaceAll(s.LastError, "\n", " ")
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%v\t%s\t%d\t%d\t%s\t%s\t%s\n",
+			s.Tunnel, s.State, s.Bastion, s.BastionConnected, remote,
+			s.ActiveConnections, s.TotalConnections,
+			formatBytes(s.BytesSent), formatBytes(s.BytesReceived), lastError)
+	}
+
+	return w.Flush()
+}
+
+// runEvents prints recent state changes of running mogura.
+func runEvents(socketPath string) error {
+	events, err := NewControlClient(socketPath).Events()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tTUNNEL\tBASTION\tSTATE\tATTEMPT\tNEXT RETRY\tERROR")
+	for _, e := range events {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			e.Time.Format("15:04:05"), orDash(e.Tunnel), e.Bastion, e.State, e.Attempt,
+			orDash(e.NextRetry), orDash(strings.ReplaceAll(e.Error, "\n", " ")))
+	}
+
+	return w.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// runTunnelCommand requests up, down or restart the tunnel to running mogura.
+func runTunnelCommand(socketPath, operation string, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: mogura %s <tunnel name>", operation)
+	}
+
+	err := NewControlClient(socketPath).Tunnel(args[0], operation)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s tunnel %s done.\n", operation, args[0])
+	return nil
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,27 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenPrivateSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+	l, err := listenPrivateSocket(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// permission is private before chmod.
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm&0077 != 0 {
+		t.Errorf("socket permission is %v, want no group and other permission", perm)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenPrivateSocket listens unix socket that only the user can connect.
+// umask is set while listening, so other users can not connect before chmod.
+func listenPrivateSocket(path string) (net.Listener, error) {
+	old := syscall.Umask(0077)
+	defer syscall.Umask(old)
+
+	return net.Listen("unix", path)
+}
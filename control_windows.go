@@ -0,0 +1,10 @@
+package main
+
+import (
+	"net"
+)
+
+// listenPrivateSocket listens unix socket. windows does not have umask, socket is protected by directory ACL.
+func listenPrivateSocket(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/reiki4040/mogura/mogura"
+)
+
+const (
+	MAX_EVENTS = 100
+)
+
+// Event is state transition of tunnel or bastion. Tunnel is empty for bastion event.
+type Event struct {
+	Time      time.Time `json:"time"`
+	Tunnel    string    `json:"tunnel,omitempty"`
+	Bastion   string    `json:"bastion"`
+	State     string    `json:"state"`
+	Attempt   int       `json:"attempt,omitempty"`
+	NextRetry string    `json:"next_retry,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// EventLog keeps recent events and logs them.
+type EventLog struct {
+	mutex  sync.Mutex
+	events []Event
+	max    int
+}
+
+func NewEventLog(max int) *EventLog {
+	return &EventLog{
+		events: make([]Event, 0, max),
+		max:    max,
+	}
+}
+
+func (el *EventLog) Add(e Event) {
+	attrs := []any{}
+	if e.Tunnel != "" {
+		attrs = append(attrs, mogura.LOG_KEY_TUNNEL, e.Tunnel)
+	}
+	attrs = append(attrs, mogura.LOG_KEY_BASTION, e.Bastion, "state", e.State)
+	if e.Attempt > 0 {
+		attrs = append(attrs, "attempt", e.Attempt)
+	}
+	if e.NextRetry != "" {
+		attrs = append(attrs, "next_retry", e.NextRetry)
+	}
+	if e.Error != "" {
+		attrs = append(attrs, mogura.LOG_KEY_ERROR, e.Error)
+	}
+
+	switch e.State {
+	case TUNNEL_STATE_RETRYING, TUNNEL_STATE_FAILED, mogura.BASTION_STATE_DISCONNECTED, mogura.BASTION_STATE_RECONNECTING:
+		slog.Warn("state changed", attrs...)
+	default:
+		slog.Info("state changed", attrs...)
+	}
+
+	el.mutex.Lock()
+	defer el.mutex.Unlock()
+
+	if len(el.events) >= el.max {
+		el.events = el.events[1:]
+	}
+	el.events = append(el.events, e)
+}
+
+// AddBastionEvent is handler for BastionPool.
+func (el *EventLog) AddBastionEvent(be mogura.BastionEvent) {
+	e := Event{
+		Time:    time.Now(),
+		Bastion: be.Bastion,
+		State:   be.State,
+		Attempt: be.Attempt,
+	}
+	if be.NextRetry > 0 {
+		e.NextRetry = be.NextRetry.Round(time.Millisecond).String()
+	}
+	if be.Err != nil {
+		e.Error = be.Err.Error()
+	}
+
+	el.Add(e)
+}
+
+// Events returns events in occurred order.
+func (el *EventLog) Events() []Event {
+	el.mutex.Lock()
+	defer el.mutex.Unlock()
+
+	events := make([]Event, len(el.events))
+	copy(events, el.events)
+
+	return events
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/reiki4040/mogura/mogura"
+)
+
+const (
+	// max wait for all tunnels are up before running the command.
+	DEFAULT_EXEC_WAIT = 30 * time.Second
+
+	// exit code when the command can not be run. same as shell.
+	EXEC_EXIT_NOT_FOUND      = 127
+	EXEC_EXIT_CANNOT_EXECUTE = 126
+)
+
+// runExec starts tunnels, runs the command with tunnel addresses in env, and returns exit code of the command.
+// tunnels are closed when the command exited.
+func runExec(confPath string, args []string) int {
+	fs := flag.NewFlagSet("exec", flag.ContinueOnError)
+	wait := fs.Duration("wait", DEFAULT_EXEC_WAIT, "max wait for all tunnels are up.")
+	err := fs.Parse(args)
+	if err != nil {
+		return 1
+	}
+
+	command := fs.Args()
+	if len(command) == 0 {
+		usage()
+		return 1
+	}
+
+	c, err := LoadConfig(confPath)
+	if err != nil {
+		slog.Error("can not load config file", "path", confPath, mogura.LOG_KEY_ERROR, err)
+		return 1
+	}
+
+	err = setupLogger(c.LogFormat, c.LogLevel)
+	if err != nil {
+		slog.Error("invalid log setting", mogura.LOG_KEY_ERROR, err)
+		return 1
+	}
+
+	tunnels, err := buildTunnels(c)
+	if err != nil {
+		slog.Error("invalid config", mogura.LOG_KEY_ERROR, err)
+		return 1
+	}
+
+	// the command expects all tunnels, so invalid tunnel is error unlike daemon mode.
+	if len(tunnels) < len(c.Tunnels) {
+		slog.Error("some tunnels are invalid. command was not run.")
+		return 1
+	}
+
+	env, err := execEnv(tunnels)
+	if err != nil {
+		slog.Error("invalid tunnel names for env", mogura.LOG_KEY_ERROR, err)
+		return 1
+	}
+
+	backoff, err := buildBackoff(c.Reconnect)
+	if err != nil {
+		slog.Error("invalid reconnect setting", mogura.LOG_KEY_ERROR, err)
+		return 1
+	}
+
+	pool := mogura.NewBastionPool(backoff, NewEventLog(MAX_EVENTS).AddBastionEvent)
+	manager := NewTunnelManager(pool, backoff, NewEventLog(MAX_EVENTS))
+	for _, t := range tunnels {
+		err := manager.Add(t)
+		if err != nil {
+			slog.Error("invalid tunnel", mogura.LOG_KEY_TUNNEL, t.name, mogura.LOG_KEY_ERROR, err)
+			return 1
+		}
+	}
+	defer manager.CloseAll()
+
+	// receive signals before starting tunnels, so Ctrl+C while waiting closes tunnels.
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+	defer signal.Stop(sigChan)
+
+	// failed tunnels are retried in background, and waited in waitTunnelsUp.
+	manager.UpAll()
+
+	err = waitTunnelsUp(manager, *wait, sigChan)
+	if err != nil {
+		slog.Error("tunnels are not up. command was not run.", mogura.LOG_KEY_ERROR, err)
+		return 1
+	}
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), env...)
+
+	err = cmd.Start()
+	if err != nil {
+		slog.Error("can not run command", "command", command[0], mogura.LOG_KEY_ERROR, err)
+		if errors.Is(err, exec.ErrNotFound) {
+			return EXEC_EXIT_NOT_FOUND
+		}
+		return EXEC_EXIT_CANNOT_EXECUTE
+	}
+
+	// pass signals to the command, and wait the command exit by it.
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-sigChan:
+				// Ctrl+C on terminal is sent to foreground process group, so the command already got it.
+				// checked on each signal, because mogura may be moved to background by job control.
+				if (sig == os.Interrupt || sig == syscall.SIGQUIT) && inForegroundProcessGroup() {
+					slog.Debug("signal is not passed, the command got it from terminal", "signal", sig)
+					continue
+				}
+				slog.Debug("pass signal to command", "signal", sig)
+				cmd.Process.Signal(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// exit status is returned as exit code, so error is not needed.
+	cmd.Wait()
+	close(done)
+
+	code := exitCode(cmd.ProcessState)
+	slog.Info("command exited, closing tunnels.", "exit_code", code)
+
+	return code
+}
+
+// waitTunnelsUp waits until all tunnels passed dial test (state up).
+// returns error when any tunnel gave up retrying, timed out or got signal.
+func waitTunnelsUp(manager *TunnelManager, wait time.Duration, sigChan <-chan os.Signal) error {
+	timeout := time.After(wait)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		notUp := make([]string, 0)
+		for _, s := range manager.Statuses() {
+			switch s.State {
+			case TUNNEL_STATE_UP:
+				continue
+			case TUNNEL_STATE_FAILED:
+				return fmt.Errorf("tunnel %s failed: %s", s.Tunnel, s.LastError)
+			}
+
+			if s.LastError != "" {
+				notUp = append(notUp, fmt.Sprintf("%s (%s)", s.Tunnel, s.LastError))
+			} else {
+				notUp = append(notUp, s.Tunnel)
+			}
+		}
+
+		if len(notUp) == 0 {
+			return nil
+		}
+		sort.Strings(notUp)
+
+		select {
+		case <-ticker.C:
+		case <-timeout:
+			return fmt.Errorf("timeout after %v: %s", wait, strings.Join(notUp, ", "))
+		case sig := <-sigChan:
+			return fmt.Errorf("got signal %v", sig)
+		}
+	}
+}
+
+// execEnv returns env vars of local addresses. MOGURA_<TUNNEL>_ADDR is host:port or unix socket path,
+// and MOGURA_<TUNNEL>_HOST, MOGURA_<TUNNEL>_PORT are added for port.
+// remote direction tunnels do not have local address.
+func execEnv(tunnels []*tunnel) ([]string, error) {
+	env := make([]string, 0, len(tunnels)*3)
+	names := make(map[string]string, len(tunnels))
+	for _, t := range tunnels {
+		if t.mogura.Direction == mogura.DIRECTION_REMOTE {
+			continue
+		}
+
+		prefix := "MOGURA_" + execEnvName(t.name) + "_"
+		if other, exists := names[prefix]; exists {
+			return nil, fmt.Errorf("tunnel %s and %s have same env name %sADDR", other, t.name, prefix)
+		}
+		names[prefix] = t.name
+
+		if t.mogura.LocalBindSocket != "" {
+			env = append(env, prefix+"ADDR="+t.mogura.LocalBindSocket)
+			continue
+		}
+
+		host, port, err := net.SplitHostPort(t.mogura.LocalBindPort)
+		if err != nil {
+			return nil, fmt.Errorf("invalid local address of tunnel %s: %v", t.name, err)
+		}
+
+		// listening on all addresses, so the command connects via loopback.
+		if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+			host = "127.0.0.1"
+			if ip.To4() == nil {
+				host = "::1"
+			}
+		}
+
+		env = append(env,
+			prefix+"ADDR="+net.JoinHostPort(host, port),
+			prefix+"HOST="+host,
+			prefix+"PORT="+port,
+		)
+	}
+
+	return env, nil
+}
+
+// execEnvName converts tunnel name to env name. ex. "orders-db" -> "ORDERS_DB"
+func execEnvName(tunnel string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - ('a' - 'A')
+		default:
+			return '_'
+		}
+	}, tunnel)
+}
+
+// exitCode returns exit code of the command. killed by signal is 128 + signal number like shell.
+func exitCode(state *os.ProcessState) int {
+	if state == nil {
+		return 1
+	}
+
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+
+	return state.ExitCode()
+}
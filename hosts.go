@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/reiki4040/mogura/mogura"
+)
+
+const (
+	DEFAULT_HOSTS_FILE = "/etc/hosts"
+
+	HOSTS_BLOCK_BEGIN = "# BEGIN mogura managed block. do not edit, it is removed when mogura stopped."
+	HOSTS_BLOCK_END   = "# END mogura managed block."
+
+	// backup before writing hosts file in place. it is used only when the file can not be replaced (bind mounted).
+	HOSTS_BACKUP_SUFFIX = ".mogura.bak"
+)
+
+// HostsEntry maps target hostname to local bind address of the tunnel.
+type HostsEntry struct {
+	Tunnel   string
+	Hostname string
+	// IP address
+	Address string
+}
+
+// HostsFile manages mogura block in hosts file.
+// the block is replaced when tunnels changed, and removed when mogura stopped.
+// block left by crashed mogura is replaced at start.
+type HostsFile struct {
+	path  string
+	mutex sync.Mutex
+}
+
+func NewHostsFile(path string) *HostsFile {
+	if path == "" {
+		path = DEFAULT_HOSTS_FILE
+	}
+
+	return &HostsFile{path: path}
+}
+
+// Sync writes entries to mogura block.
+func (h *HostsFile) Sync(entries []HostsEntry) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.write(entries)
+}
+
+// Remove removes mogura block.
+func (h *HostsFile) Remove() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.write(nil)
+}
+
+func (h *HostsFile) write(entries []HostsEntry) error {
+	fi, err := os.Stat(h.path)
+	if err != nil {
+		return fmt.Errorf("can not read hosts file: %v", err)
+	}
+
+	current, err := os.ReadFile(h.path)
+	if err != nil {
+		return fmt.Errorf("can not read hosts file: %v", err)
+	}
+
+	content := removeHostsBlock(string(current))
+	if len(entries) > 0 {
+		if content != "" && !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+		content += hostsBlock(entries)
+	}
+
+	if content == string(current) {
+		return nil
+	}
+
+	// replace with rename, so crash or full disk while writing does not break hosts file.
+	err = replaceFile(h.path, []byte(content), fi.Mode().Perm())
+	if errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.EXDEV) {
+		// bind mounted hosts file (ex. docker) can not be replaced, so write in place after backup.
+		backup := h.path + HOSTS_BACKUP_SUFFIX
+		slog.Warn("hosts file can not be replaced, write in place", "path", h.path, "backup", backup, mogura.LOG_KEY_ERROR, err)
+		err = writeInPlace(h.path, backup, current, []byte(content), fi.Mode().Perm())
+	}
+	if err != nil {
+		return fmt.Errorf("can not write hosts file: %v", err)
+	}
+
+	return nil
+}
+
+// replaceFile writes content to temp file in same directory, and renames it to path.
+func replaceFile(path string, content []byte, perm os.FileMode) error {
+	// keep symlink, replace the linked file.
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".mogura-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = writeAndSync(tmp, content)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	// CreateTemp makes 0600 file.
+	err = os.Chmod(tmp.Name(), perm)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// writeInPlace writes backup of current content, then overwrites path.
+func writeInPlace(path, backup string, current, content []byte, perm os.FileMode) error {
+	b, err := os.OpenFile(backup, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return fmt.Errorf("can not write backup: %v", err)
+	}
+	err = writeAndSync(b, current)
+	b.Close()
+	if err != nil {
+		return fmt.Errorf("can not write backup: %v", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	err = writeAndSync(f, content)
+	f.Close()
+
+	return err
+}
+
+func writeAndSync(f *os.File, content []byte) error {
+	_, err := f.Write(content)
+	if err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// removeHostsBlock removes mogura block. unterminated block (ex. crashed while writing) is removed until the end.
+func removeHostsBlock(content string) string {
+	lines := strings.SplitAfter(content, "\n")
+	kept := make([]string, 0, len(lines))
+	inBlock := false
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == HOSTS_BLOCK_BEGIN:
+			inBlock = true
+		case trimmed == HOSTS_BLOCK_END && inBlock:
+			inBlock = false
+		case !inBlock:
+			kept = append(kept, line)
+		}
+	}
+
+	return strings.Join(kept, "")
+}
+
+func hostsBlock(entries []HostsEntry) string {
+	b := &strings.Builder{}
+	b.WriteString(HOSTS_BLOCK_BEGIN + "\n")
+	for _, e := range entries {
+		fmt.Fprintf(b, "%s\t%s\t# %s\n", e.Address, e.Hostname, e.Tunnel)
+	}
+	b.WriteString(HOSTS_BLOCK_END + "\n")
+
+	return b.String()
+}
+
+// buildHostsEntries returns entries of host targets. IP and SRV targets do not need hosts entry.
+// when multiple tunnels have same hostname with different address, first one is used.
+func buildHostsEntries(endpoints []HostsEntry) []HostsEntry {
+	entries := make([]HostsEntry, 0, len(endpoints))
+	seen := make(map[string]HostsEntry, len(endpoints))
+	for _, e := range endpoints {
+		hostname := strings.ToLower(strings.TrimSuffix(e.Hostname, "."))
+		if hostname == "" || hostname == "localhost" || net.ParseIP(hostname) != nil {
+			continue
+		}
+
+		if other, exists := seen[hostname]; exists {
+			if other.Address != e.Address {
+				slog.Warn("hostname is used by other tunnel with different address, skip hosts entry.", mogura.LOG_KEY_TUNNEL, e.Tunnel, "hostname", hostname, "other", other.Tunnel)
+			}
+			continue
+		}
+
+		e.Hostname = hostname
+		seen[hostname] = e
+		entries = append(entries, e)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Hostname < entries[j].Hostname
+	})
+
+	return entries
+}
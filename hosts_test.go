@@ -0,0 +1,250 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeHostsFile(t *testing.T, content string) *HostsFile {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "hosts")
+	err := os.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewHostsFile(path)
+}
+
+func readHostsFile(t *testing.T, h *HostsFile) string {
+	t.Helper()
+
+	b, err := os.ReadFile(h.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b)
+}
+
+func TestHostsFileSync(t *testing.T) {
+	entries := []HostsEntry{
+		{Tunnel: "api", Hostname: "api.internal", Address: "127.0.0.2"},
+	}
+	block := HOSTS_BLOCK_BEGIN + "\n" +
+		"127.0.0.2\tapi.internal\t# api\n" +
+		HOSTS_BLOCK_END + "\n"
+
+	tests := []struct {
+		name    string
+		current string
+		entries []HostsEntry
+		want    string
+	}{
+		{
+			name:    "add block",
+			current: "127.0.0.1\tlocalhost\n",
+			entries: entries,
+			want:    "127.0.0.1\tlocalhost\n" + block,
+		},
+		{
+			name: "replace existing block",
+			current: "127.0.0.1\tlocalhost\n" +
+				HOSTS_BLOCK_BEGIN + "\n" +
+				"127.0.0.9\told.internal\t# old\n" +
+				HOSTS_BLOCK_END + "\n" +
+				"10.0.0.1\tother\n",
+			entries: entries,
+			want:    "127.0.0.1\tlocalhost\n10.0.0.1\tother\n" + block,
+		},
+		{
+			name: "unterminated block is removed until the end",
+			current: "127.0.0.1\tlocalhost\n" +
+				HOSTS_BLOCK_BEGIN + "\n" +
+				"127.0.0.9\told.internal\t# old\n",
+			entries: entries,
+			want:    "127.0.0.1\tlocalhost\n" + block,
+		},
+		{
+			name:    "missing final newline",
+			current: "127.0.0.1\tlocalhost",
+			entries: entries,
+			want:    "127.0.0.1\tlocalhost\n" + block,
+		},
+		{
+			name:    "no entries does not write block",
+			current: "127.0.0.1\tlocalhost\n",
+			entries: nil,
+			want:    "127.0.0.1\tlocalhost\n",
+		},
+		{
+			name:    "no entries in empty file",
+			current: "",
+			entries: nil,
+			want:    "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := writeHostsFile(t, tt.current)
+			err := h.Sync(tt.entries)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := readHostsFile(t, h); got != tt.want {
+				t.Errorf("hosts file is\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostsFileRemove(t *testing.T) {
+	tests := []struct {
+		name    string
+		current string
+		want    string
+	}{
+		{
+			name: "block left by crash",
+			current: "127.0.0.1\tlocalhost\n" +
+				HOSTS_BLOCK_BEGIN + "\n" +
+				"127.0.0.2\tapi.internal\t# api\n" +
+				HOSTS_BLOCK_END + "\n" +
+				"10.0.0.1\tother",
+			// missing final newline is kept.
+			want: "127.0.0.1\tlocalhost\n10.0.0.1\tother",
+		},
+		{
+			name:    "no block is not changed",
+			current: "127.0.0.1\tlocalhost",
+			want:    "127.0.0.1\tlocalhost",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := writeHostsFile(t, tt.current)
+			err := h.Remove()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := readHostsFile(t, h); got != tt.want {
+				t.Errorf("hosts file is\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostsFileKeepsPermission(t *testing.T) {
+	h := writeHostsFile(t, "127.0.0.1\tlocalhost\n")
+	err := os.Chmod(h.path, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = h.Sync([]HostsEntry{{Tunnel: "api", Hostname: "api.internal", Address: "127.0.0.2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(h.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("permission is %v, want 0640", fi.Mode().Perm())
+	}
+}
+
+func TestBuildHostsEntries(t *testing.T) {
+	got := buildHostsEntries([]HostsEntry{
+		{Tunnel: "b", Hostname: "B.internal.", Address: "127.0.0.3"},
+		{Tunnel: "a", Hostname: "a.internal", Address: "127.0.0.2"},
+		{Tunnel: "ip", Hostname: "10.0.0.1", Address: "127.0.0.4"},
+		{Tunnel: "local", Hostname: "localhost", Address: "127.0.0.5"},
+		{Tunnel: "dup", Hostname: "a.internal", Address: "127.0.0.6"},
+	})
+
+	want := []HostsEntry{
+		{Tunnel: "a", Hostname: "a.internal", Address: "127.0.0.2"},
+		{Tunnel: "b", Hostname: "b.internal", Address: "127.0.0.3"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("entries[%d] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestHostsFileReplace(t *testing.T) {
+	h := writeHostsFile(t, "127.0.0.1\tlocalhost\n")
+	dir := filepath.Dir(h.path)
+
+	// hosts file is symlink, like /etc/hosts on some systems.
+	link := filepath.Join(dir, "hosts-link")
+	err := os.Symlink(h.path, link)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = NewHostsFile(link).Sync([]HostsEntry{{Tunnel: "api", Hostname: "api.internal", Address: "127.0.0.2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Lstat(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		t.Error("symlink is replaced with file")
+	}
+
+	want := "127.0.0.1\tlocalhost\n" + HOSTS_BLOCK_BEGIN + "\n127.0.0.2\tapi.internal\t# api\n" + HOSTS_BLOCK_END + "\n"
+	if got := readHostsFile(t, h); got != want {
+		t.Errorf("hosts file is\n%q\nwant\n%q", got, want)
+	}
+
+	// temp file is not left.
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		names := make([]string, 0, len(files))
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		t.Errorf("files in dir are %v, want hosts and hosts-link", names)
+	}
+}
+
+func TestWriteInPlace(t *testing.T) {
+	h := writeHostsFile(t, "127.0.0.1\tlocalhost\n")
+	backup := h.path + HOSTS_BACKUP_SUFFIX
+
+	err := writeInPlace(h.path, backup, []byte("127.0.0.1\tlocalhost\n"), []byte("127.0.0.1\tlocalhost\n127.0.0.2\tapi.internal\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := readHostsFile(t, h), "127.0.0.1\tlocalhost\n127.0.0.2\tapi.internal\n"; got != want {
+		t.Errorf("hosts file is %q, want %q", got, want)
+	}
+
+	b, err := os.ReadFile(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "127.0.0.1\tlocalhost\n" {
+		t.Errorf("backup is %q, want previous content", b)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strconv"
+)
+
+const (
+	// local_bind_address value for automatic 127.0.0.x allocation.
+	LOCAL_BIND_ADDRESS_AUTO = "auto"
+
+	// 127.0.0.1 is default localhost, so auto allocation uses 127.0.0.2 - 127.0.0.254
+	autoLocalAddressMin = 2
+	autoLocalAddressMax = 254
+)
+
+// localAddressAllocator assigns distinct loopback address to tunnels,
+// so tunnels can use same port (ex. 5432 for multiple Postgres).
+type localAddressAllocator struct {
+	used map[string]struct{}
+}
+
+// newLocalAddressAllocator reserves addresses that are specified in config.
+func newLocalAddressAllocator(tunnels []TunnelConfig) *localAddressAllocator {
+	a := &localAddressAllocator{
+		used: make(map[string]struct{}),
+	}
+
+	for _, t := range tunnels {
+		if t.LocalBindAddress != "" && t.LocalBindAddress != LOCAL_BIND_ADDRESS_AUTO {
+			a.used[normalizeLocalAddress(t.LocalBindAddress)] = struct{}{}
+		}
+	}
+
+	return a
+}
+
+// allocate returns 127.0.0.x for the tunnel. address is decided by hash of tunnel name,
+// so it is not changed by adding or removing other tunnels (reload keeps the tunnel).
+func (a *localAddressAllocator) allocate(name string) (string, error) {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+
+	size := uint32(autoLocalAddressMax - autoLocalAddressMin + 1)
+	start := h.Sum32() % size
+	for i := uint32(0); i < size; i++ {
+		address := "127.0.0." + strconv.Itoa(int((start+i)%size)+autoLocalAddressMin)
+		if _, exists := a.used[address]; !exists {
+			a.used[address] = struct{}{}
+			return address, nil
+		}
+	}
+
+	return "", fmt.Errorf("no available local address for auto.")
+}
+
+// localBindHostPort returns listening address. empty address is localhost.
+// it does not depend on ip_family, because ip_family is for the target.
+func localBindHostPort(address string, port int) string {
+	if address == "" {
+		return localport(port)
+	}
+
+	return hostport(address, port)
+}
+
+// normalizeLocalAddress returns IP string for comparing. "localhost" and empty is loopback.
+func normalizeLocalAddress(address string) string {
+	if address == "" || address == "localhost" {
+		return "127.0.0.1"
+	}
+
+	if ip := net.ParseIP(address); ip != nil {
+		return ip.String()
+	}
+
+	return address
+}
+
+// connectAddress returns IP string that local apps connect to the tunnel bound on address.
+// unspecified address (0.0.0.0 or ::) is bound on all addresses, so loopback is used.
+// hosts file and local DNS use it, so both features answer same address.
+func connectAddress(address string) string {
+	address = normalizeLocalAddress(address)
+	if ip := net.ParseIP(address); ip != nil && ip.IsUnspecified() {
+		if ip.To4() == nil {
+			return "::1"
+		}
+		return "127.0.0.1"
+	}
+
+	return address
+}
+
+// localBindConflicts returns whether two listening addresses can not be bound at the same time.
+func localBindConflicts(a, b string) bool {
+	if a == b {
+		return true
+	}
+
+	// unspecified address (0.0.0.0 or ::) is bound on all addresses.
+	ipA := net.ParseIP(a)
+	ipB := net.ParseIP(b)
+	return (ipA != nil && ipA.IsUnspecified()) || (ipB != nil && ipB.IsUnspecified())
+}
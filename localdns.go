@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	DEFAULT_LOCAL_DNS_DOMAIN = "mogura.local"
+
+	// short TTL, because tunnels are changed by reload.
+	LOCAL_DNS_TTL = 5
+)
+
+// LocalEndpoint is local listening address of the tunnel.
+type LocalEndpoint struct {
+	Tunnel string
+	// host:port
+	Address string
+}
+
+// LocalEndpointProvider returns current local endpoints of tunnels.
+type LocalEndpointProvider interface {
+	LocalEndpoints() []LocalEndpoint
+}
+
+// LocalDNSServer answers tunnel names (ex. orders.mogura.local) with local endpoint.
+// A/AAAA is local bind address and SRV is local bind port.
+type LocalDNSServer struct {
+	domain   string
+	provider LocalEndpointProvider
+
+	udpServer *dns.Server
+	tcpServer *dns.Server
+}
+
+// StartLocalDNSServer listens UDP and TCP on listen address.
+func StartLocalDNSServer(listen, domain string, provider LocalEndpointProvider) (*LocalDNSServer, error) {
+	if domain == "" {
+		domain = DEFAULT_LOCAL_DNS_DOMAIN
+	}
+
+	if _, ok := dns.IsDomainName(domain); !ok {
+		return nil, fmt.Errorf("invalid local dns domain %s", domain)
+	}
+
+	s := &LocalDNSServer{
+		domain:   dns.Fqdn(strings.ToLower(domain)),
+		provider: provider,
+	}
+
+	pc, err := net.ListenPacket("udp", listen)
+	if err != nil {
+		return nil, fmt.Errorf("can not listen local dns udp %s: %v", listen, err)
+	}
+
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		return nil, fmt.Errorf("can not listen local dns tcp %s: %v", listen, err)
+	}
+
+	handler := dns.HandlerFunc(s.handle)
+	s.udpServer = &dns.Server{PacketConn: pc, Handler: handler}
+	s.tcpServer = &dns.Server{Listener: l, Handler: handler}
+	go s.udpServer.ActivateAndServe()
+	go s.tcpServer.ActivateAndServe()
+
+	return s, nil
+}
+
+func (s *LocalDNSServer) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	uErr := s.udpServer.ShutdownContext(ctx)
+	tErr := s.tcpServer.ShutdownContext(ctx)
+	if uErr != nil {
+		return uErr
+	}
+
+	return tErr
+}
+
+func (s *LocalDNSServer) handle(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+
+	if len(r.Question) != 1 {
+		m.Rcode = dns.RcodeFormatError
+		w.WriteMsg(m)
+		return
+	}
+
+	q := r.Question[0]
+	name := strings.ToLower(q.Name)
+	if !dns.IsSubDomain(s.domain, name) {
+		// not our zone. mogura is not recursive resolver.
+		m.Rcode = dns.RcodeRefused
+		m.Authoritative = false
+		w.WriteMsg(m)
+		return
+	}
+
+	// zone apex exists, but it has no records.
+	if name == s.domain {
+		w.WriteMsg(m)
+		return
+	}
+
+	// SRV also accepts _<tunnel>._tcp.<domain>
+	host := name
+	if q.Qtype == dns.TypeSRV {
+		labels := dns.SplitDomainName(name)
+		if len(labels) > 2 && strings.HasPrefix(labels[0], "_") && labels[1] == "_tcp" {
+			host = strings.TrimPrefix(labels[0], "_") + "." + strings.Join(labels[2:], ".") + "."
+		}
+	}
+
+	ip, port, found := s.lookup(host)
+	if !found {
+		m.Rcode = dns.RcodeNameError
+		w.WriteMsg(m)
+		return
+	}
+
+	address := addressRecord(host, ip)
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeAAAA, dns.TypeANY:
+		if address.Header().Rrtype == q.Qtype || q.Qtype == dns.TypeANY {
+			m.Answer = append(m.Answer, address)
+		}
+	case dns.TypeSRV:
+		m.Answer = append(m.Answer, &dns.SRV{
+			Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: LOCAL_DNS_TTL},
+			Port:   uint16(port),
+			Target: host,
+		})
+		m.Extra = append(m.Extra, address)
+	}
+
+	w.WriteMsg(m)
+}
+
+// lookup returns local bind address of the tunnel for name.
+func (s *LocalDNSServer) lookup(name string) (net.IP, int, bool) {
+	for _, e := range s.provider.LocalEndpoints() {
+		if localDNSName(e.Tunnel)+"."+s.domain != name {
+			continue
+		}
+
+		host, p, err := net.SplitHostPort(e.Address)
+		if err != nil {
+			return nil, 0, false
+		}
+
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, 0, false
+		}
+
+		ip := net.ParseIP(connectAddress(host))
+		if ip == nil {
+			return nil, 0, false
+		}
+
+		return ip, port, true
+	}
+
+	return nil, 0, false
+}
+
+func addressRecord(name string, ip net.IP) dns.RR {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: LOCAL_DNS_TTL},
+			A:   ip4,
+		}
+	}
+
+	return &dns.AAAA{
+		Hdr:  dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: LOCAL_DNS_TTL},
+		AAAA: ip,
+	}
+}
+
+// localDNSName converts tunnel name to DNS label. ex. "Orders API" -> "orders-api"
+func localDNSName(tunnel string) string {
+	label := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + ('a' - 'A')
+		default:
+			return '-'
+		}
+	}, tunnel)
+
+	return strings.Trim(label, "-")
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+type staticEndpoints []LocalEndpoint
+
+func (e staticEndpoints) LocalEndpoints() []LocalEndpoint {
+	return e
+}
+
+func TestConnectAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"", "127.0.0.1"},
+		{"localhost", "127.0.0.1"},
+		{"127.0.0.2", "127.0.0.2"},
+		{"0.0.0.0", "127.0.0.1"},
+		{"::", "::1"},
+		{"::1", "::1"},
+	}
+
+	for _, tt := range tests {
+		if got := connectAddress(tt.address); got != tt.want {
+			t.Errorf("connectAddress(%q) = %s, want %s", tt.address, got, tt.want)
+		}
+	}
+}
+
+func TestLocalDNSServer(t *testing.T) {
+	s, err := StartLocalDNSServer("127.0.0.1:0", "", staticEndpoints{
+		{Tunnel: "api", Address: "127.0.0.2:443"},
+		{Tunnel: "Orders DB", Address: "localhost:5432"},
+		{Tunnel: "all", Address: "0.0.0.0:6379"},
+		{Tunnel: "all6", Address: "[::]:6380"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	addr := s.udpServer.PacketConn.LocalAddr().String()
+
+	tests := []struct {
+		name      string
+		qtype     uint16
+		wantRcode int
+		// A/AAAA address or SRV port
+		want []string
+	}{
+		{name: "api.mogura.local.", qtype: dns.TypeA, wantRcode: dns.RcodeSuccess, want: []string{"127.0.0.2"}},
+		{name: "orders-db.mogura.local.", qtype: dns.TypeA, wantRcode: dns.RcodeSuccess, want: []string{"127.0.0.1"}},
+		{name: "all.mogura.local.", qtype: dns.TypeA, wantRcode: dns.RcodeSuccess, want: []string{"127.0.0.1"}},
+		{name: "all6.mogura.local.", qtype: dns.TypeAAAA, wantRcode: dns.RcodeSuccess, want: []string{"::1"}},
+		// name exists but no record for the type.
+		{name: "api.mogura.local.", qtype: dns.TypeAAAA, wantRcode: dns.RcodeSuccess},
+		{name: "_api._tcp.mogura.local.", qtype: dns.TypeSRV, wantRcode: dns.RcodeSuccess, want: []string{"443"}},
+		{name: "mogura.local.", qtype: dns.TypeA, wantRcode: dns.RcodeSuccess},
+		{name: "mogura.local.", qtype: dns.TypeSOA, wantRcode: dns.RcodeSuccess},
+		{name: "unknown.mogura.local.", qtype: dns.TypeA, wantRcode: dns.RcodeNameError},
+		{name: "example.com.", qtype: dns.TypeA, wantRcode: dns.RcodeRefused},
+	}
+
+	c := &dns.Client{}
+	for _, tt := range tests {
+		t.Run(dns.TypeToString[tt.qtype]+" "+tt.name, func(t *testing.T) {
+			m := new(dns.Msg)
+			m.SetQuestion(tt.name, tt.qtype)
+			r, _, err := c.Exchange(m, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if r.Rcode != tt.wantRcode {
+				t.Fatalf("rcode is %s, want %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.wantRcode])
+			}
+
+			got := make([]string, 0, len(r.Answer))
+			for _, rr := range r.Answer {
+				switch v := rr.(type) {
+				case *dns.A:
+					got = append(got, v.A.String())
+				case *dns.AAAA:
+					got = append(got, v.AAAA.String())
+				case *dns.SRV:
+					got = append(got, strconv.Itoa(int(v.Port)))
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("answer is %v, want %v", got, tt.want)
+			}
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Errorf("answer is %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
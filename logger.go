@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/reiki4040/mogura/mogura"
+)
+
+const (
+	LOG_FORMAT_TEXT = "text"
+	LOG_FORMAT_JSON = "json"
+)
+
+// setupLogger sets logger for main and mogura package.
+// empty format keeps default log style output.
+func setupLogger(format, level string) error {
+	var l slog.Level
+	switch strings.ToLower(level) {
+	case "", "info":
+		l = slog.LevelInfo
+	case "debug":
+		l = slog.LevelDebug
+	case "warn":
+		l = slog.LevelWarn
+	case "error":
+		l = slog.LevelError
+	default:
+		return fmt.Errorf("invalid log_level %s", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: l}
+	var logger *slog.Logger
+	switch format {
+	case "":
+		slog.SetLogLoggerLevel(l)
+		return nil
+	case LOG_FORMAT_TEXT:
+		logger = slog.New(slog.NewTextHandler(os.Stderr, opts))
+	case LOG_FORMAT_JSON:
+		logger = slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	default:
+		return fmt.Errorf("invalid log_format %s", format)
+	}
+
+	slog.SetDefault(logger)
+	mogura.SetLogger(logger)
+
+	return nil
+}
+
+// fatal logs error and exit.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -4,10 +4,11 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"os"
 	"os/signal"
-	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/reiki4040/mogura/mogura"
@@ -19,6 +20,19 @@ const (
 usage:
   
   mogura [-config config.yml] 
+  mogura [-config config.yml] status
+  mogura [-config config.yml] up|down|restart <tunnel name>
+  mogura [-config config.yml] events
+  mogura [-config config.yml] exec [-wait 30s] -- <command> [args...]
+
+commands:
+  status: show tunnels status of running mogura.
+  up: start the tunnel in running mogura.
+  down: stop the tunnel in running mogura. other tunnels are not affected.
+  restart: stop and start the tunnel in running mogura.
+  events: show recent tunnel and bastion state changes in running mogura.
+  exec: start tunnels, run the command when all tunnels are up, and close tunnels when the command exited.
+        local addresses are passed as MOGURA_<TUNNEL>_ADDR, _HOST and _PORT env. exit code is the command's.
 
 options:
   -v: show version, revision, go version.
@@ -44,8 +58,6 @@ func init() {
 	flag.BoolVar(&showUsage, "h", false, "show usage.")
 	flag.BoolVar(&showVer, "v", false, "show version")
 	flag.StringVar(&optConfigFilePath, "config", "", "config file path. default: ~/.mogura/config.yml")
-
-	flag.Parse()
 }
 
 func usage() {
@@ -57,6 +69,9 @@ func showVersion() {
 }
 
 func main() {
+	// parse in main instead of init, because go test has own flags.
+	flag.Parse()
+
 	if showUsage {
 		usage()
 		os.Exit(0)
@@ -73,159 +88,753 @@ func main() {
 		confPath = optConfigFilePath
 	}
 
+	// exec runs tunnels by itself, not via running mogura.
+	if flag.Arg(0) == "exec" {
+		os.Exit(runExec(confPath, flag.Args()[1:]))
+	}
+
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(confPath, flag.Arg(0), flag.Args()[1:]))
+	}
+
 	c, err := LoadConfig(confPath)
 	if err != nil {
-		log.Fatalf("can not load config file %s: %v", confPath, err)
+		fatal("can not load config file", "path", confPath, mogura.LOG_KEY_ERROR, err)
 	}
 
-	// default name is Bastion
-	basName := c.Bastion.Name
-	if basName == "" {
-		basName = "Bastion"
+	err = setupLogger(c.LogFormat, c.LogLevel)
+	if err != nil {
+		fatal("invalid log setting", mogura.LOG_KEY_ERROR, err)
 	}
 
-	if c.Bastion.Host == "" {
-		log.Fatalf("bastion host is required.")
+	tunnels, err := buildTunnels(c)
+	if err != nil {
+		fatal("invalid config", mogura.LOG_KEY_ERROR, err)
 	}
 
-	// default port 22(ssh default)
-	basPort := c.Bastion.Port
-	if basPort == 0 {
-		basPort = 22
+	backoff, err := buildBackoff(c.Reconnect)
+	if err != nil {
+		fatal("invalid reconnect setting", mogura.LOG_KEY_ERROR, err)
 	}
+	events := NewEventLog(MAX_EVENTS)
 
-	bastionHostPort := hostport(c.Bastion.Host, basPort)
+	// tunnels share one ssh connection per bastion.
+	pool := mogura.NewBastionPool(backoff, events.AddBastionEvent)
 
-	// default key path "~/.ssh/id_rsa"
-	basKeyPath := c.Bastion.KeyPath
-	if basKeyPath == "" {
-		basKeyPath = "~/.ssh/id_rsa"
+	manager := NewTunnelManager(pool, backoff, events)
+	for _, t := range tunnels {
+		err := manager.Add(t)
+		if err != nil {
+			slog.Error("invalid tunnel, skip.", mogura.LOG_KEY_TUNNEL, t.name, mogura.LOG_KEY_ERROR, err)
+		}
 	}
+	validTunnelCount := len(tunnels)
 
-	// resolved "~/"
-	rKeyPath, err := ResolveUserHome(basKeyPath)
+	// all tunnel is wrong
+	if validTunnelCount == 0 {
+		fatal("all tunnels are invalid. mogura was not started.")
+	}
+
+	var hostsFile *HostsFile
+	if c.ManageHosts {
+		hostsFile = NewHostsFile(c.HostsFile)
+		err := hostsFile.Sync(manager.HostsEntries())
+		if err != nil {
+			// tunnels work without hosts entries.
+			slog.Warn("hosts file is not updated", "path", hostsFile.path, mogura.LOG_KEY_ERROR, err)
+		}
+	}
+
+	// receive SIGHUP before starting tunnels, because starting may take long time with unreachable bastion.
+	// SIGHUP while starting is queued and reloaded after started, instead of killing mogura by default action.
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	defer signal.Stop(hupChan)
+
+	openedTunnelCount := manager.UpAll()
+
+	if validTunnelCount < len(c.Tunnels) {
+		slog.Warn("some tunnels are invalid. those tunnel were not started.")
+	}
+
+	if openedTunnelCount < validTunnelCount {
+		slog.Warn("some tunnels were failed to start. those tunnels are retried in background.")
+	}
+
+	controlServer, err := StartControlServer(c.GetControlSocketPath(), manager)
+	if err != nil {
+		// tunnels work without control socket.
+		slog.Warn("control socket is not available", mogura.LOG_KEY_ERROR, err)
+	}
+
+	var metricsServer *MetricsServer
+	if c.MetricsListen != "" {
+		metricsServer, err = StartMetricsServer(c.MetricsListen, manager)
+		if err != nil {
+			slog.Warn("metrics is not available", mogura.LOG_KEY_ERROR, err)
+		} else {
+			slog.Info("metrics is served", "url", "http://"+c.MetricsListen+"/metrics")
+		}
+	}
+
+	var localDNSServer *LocalDNSServer
+	if c.LocalDNS.Listen != "" {
+		localDNSServer, err = StartLocalDNSServer(c.LocalDNS.Listen, c.LocalDNS.Domain, manager)
+		if err != nil {
+			slog.Warn("local dns is not available", mogura.LOG_KEY_ERROR, err)
+		} else {
+			slog.Info("local dns is served", "listen", c.LocalDNS.Listen, "domain", localDNSServer.domain)
+		}
+	}
+
+	slog.Info("mogura is started. mogura stop with press Ctrl+C")
+
+	// Create a context that will be canceled on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// reload config on SIGHUP until the interrupt signal
+	reloadLoop(ctx, confPath, manager, c.WatchConfig, hupChan, func() {
+		if hostsFile == nil {
+			return
+		}
+
+		err := hostsFile.Sync(manager.HostsEntries())
+		if err != nil {
+			slog.Warn("hosts file is not updated", "path", hostsFile.path, mogura.LOG_KEY_ERROR, err)
+		}
+	})
+	slog.Info("stopping mogura because got signal...")
+	if controlServer != nil {
+		controlServer.Close()
+	}
+	if metricsServer != nil {
+		metricsServer.Close()
+	}
+	if localDNSServer != nil {
+		localDNSServer.Close()
+	}
+	if hostsFile != nil {
+		err := hostsFile.Remove()
+		if err != nil {
+			slog.Warn("can not remove hosts entries", "path", hostsFile.path, mogura.LOG_KEY_ERROR, err)
+		}
+	}
+	manager.CloseAll()
+	slog.Info("stopped mogura.")
+}
+
+// buildBackoff builds backoff from reconnect config, empty values are default.
+func buildBackoff(rc ReconnectConfig) (mogura.Backoff, error) {
+	b := mogura.DefaultBackoff()
+	if rc.InitialInterval != "" {
+		d, err := time.ParseDuration(rc.InitialInterval)
+		if err != nil || d <= 0 {
+			return b, fmt.Errorf("invalid initial_interval %s", rc.InitialInterval)
+		}
+		b.InitialInterval = d
+	}
+
+	if rc.MaxInterval != "" {
+		d, err := time.ParseDuration(rc.MaxInterval)
+		if err != nil || d <= 0 {
+			return b, fmt.Errorf("invalid max_interval %s", rc.MaxInterval)
+		}
+		b.MaxInterval = d
+	}
+
+	if b.MaxInterval < b.InitialInterval {
+		return b, fmt.Errorf("max_interval must be greater than initial_interval")
+	}
+
+	if rc.Multiplier != 0 {
+		if rc.Multiplier < 1 {
+			return b, fmt.Errorf("multiplier must be 1 or more")
+		}
+		b.Multiplier = rc.Multiplier
+	}
+
+	if rc.Jitter != 0 {
+		if rc.Jitter < 0 || rc.Jitter > 1 {
+			return b, fmt.Errorf("jitter must be between 0 and 1")
+		}
+		b.Jitter = rc.Jitter
+	}
+
+	if rc.MaxAttempts < 0 {
+		return b, fmt.Errorf("max_attempts must be 0 (unlimited) or more")
+	}
+	b.MaxAttempts = rc.MaxAttempts
+
+	return b, nil
+}
+
+func buildResolveOptions(rc ResolveConfig) (mogura.ResolveOptions, error) {
+	o := mogura.ResolveOptions{
+		MinInterval: mogura.DEFAULT_RESOLVE_MIN_INTERVAL,
+		MaxInterval: mogura.DEFAULT_RESOLVE_MAX_INTERVAL,
+	}
+
+	if rc.MinInterval != "" {
+		d, err := time.ParseDuration(rc.MinInterval)
+		if err != nil || d <= 0 {
+			return o, fmt.Errorf("invalid resolve min_interval %s", rc.MinInterval)
+		}
+		o.MinInterval = d
+	}
+
+	if rc.MaxInterval != "" {
+		d, err := time.ParseDuration(rc.MaxInterval)
+		if err != nil || d <= 0 {
+			return o, fmt.Errorf("invalid resolve max_interval %s", rc.MaxInterval)
+		}
+		o.MaxInterval = d
+	}
+
+	if o.MaxInterval < o.MinInterval {
+		return o, fmt.Errorf("resolve max_interval must be greater than min_interval")
+	}
+
+	return o, nil
+}
+
+// buildDNSOptions validates remote DNS settings of the bastion.
+func buildDNSOptions(sc SSHConfig) (mogura.DNSOptions, error) {
+	o := mogura.DNSOptions{
+		Resolvers: sc.RemoteDNS,
+		UDPHelper: sc.RemoteDNSUDPHelper,
+	}
+
+	if sc.RemoteDNSUDPHelper != "" {
+		err := mogura.ValidateDNSUDPHelper(sc.RemoteDNSUDPHelper)
+		if err != nil {
+			return o, fmt.Errorf("invalid remote_dns_udp_helper: %v", err)
+		}
+	}
+
+	switch sc.RemoteDNSProtocol {
+	case "", mogura.DNS_PROTOCOL_TCP:
+		o.Protocol = mogura.DNS_PROTOCOL_TCP
+	case mogura.DNS_PROTOCOL_UDP:
+		o.Protocol = mogura.DNS_PROTOCOL_UDP
+	default:
+		return o, fmt.Errorf("invalid remote_dns_protocol %s", sc.RemoteDNSProtocol)
+	}
+
+	if sc.RemoteDNSTimeout != "" {
+		d, err := time.ParseDuration(sc.RemoteDNSTimeout)
+		if err != nil || d <= 0 {
+			return o, fmt.Errorf("invalid remote_dns_timeout %s", sc.RemoteDNSTimeout)
+		}
+		o.Timeout = d
+	}
+
+	if sc.RemoteDNSUDPSize != 0 {
+		if sc.RemoteDNSUDPSize < 512 || sc.RemoteDNSUDPSize > 65535 {
+			return o, fmt.Errorf("remote_dns_udp_size must be between 512 and 65535")
+		}
+		o.UDPSize = uint16(sc.RemoteDNSUDPSize)
+	}
+
+	return o, nil
+}
+
+// buildTunnels validates config and builds tunnels. invalid tunnels are skipped with error log.
+// invalid bastion is error.
+func buildTunnels(c *Config) ([]*tunnel, error) {
+	basSSHConfigs := c.BastionSSHConfigs()
+	if len(basSSHConfigs) == 0 {
+		return nil, fmt.Errorf("bastion is required. set bastion_ssh_config or bastions.")
+	}
+
+	basConfigs := make(map[string]mogura.BastionConfig, len(basSSHConfigs))
+	basDNS := make(map[string]mogura.DNSOptions, len(basSSHConfigs))
+	basNames := make(map[string]string, len(basSSHConfigs))
+	for key, sc := range basSSHConfigs {
+		basConfig, err := resolveBastion(sc)
+		if err == nil {
+			basDNS[key], err = buildDNSOptions(sc)
+		}
+		if err != nil {
+			if key == DEFAULT_BASTION_KEY {
+				return nil, fmt.Errorf("invalid bastion_ssh_config: %v", err)
+			}
+			return nil, fmt.Errorf("invalid bastion %s: %v", key, err)
+		}
+
+		// bastion name is connection sharing key, so must be unique.
+		if other, exists := basNames[basConfig.Name]; exists {
+			return nil, fmt.Errorf("duplicate bastion name %s in bastions %s and %s", basConfig.Name, other, key)
+		}
+		basNames[basConfig.Name] = key
+		basConfigs[key] = basConfig
+	}
+
+	resolve, err := buildResolveOptions(c.Resolve)
 	if err != nil {
-		log.Fatalf("can not resolved user home path in %s: %v", basKeyPath, err)
+		return nil, err
 	}
 
-	moguraMap := make(map[string]*mogura.Mogura, len(c.Tunnels))
-	openedTunnelCount := 0
-	portMap := make(map[int]struct{}, len(c.Tunnels))
+	tunnels := make([]*tunnel, 0, len(c.Tunnels))
+	names := make(map[string]struct{}, len(c.Tunnels))
+	// bound local addresses per port
+	portMap := make(map[int][]string, len(c.Tunnels))
+	socketMap := make(map[string]struct{}, len(c.Tunnels))
+	allocator := newLocalAddressAllocator(c.Tunnels)
 	for i, t := range c.Tunnels {
 		name := t.Name
 		if t.Name == "" {
 			name = fmt.Sprintf("no name settting %d", i+1)
 		}
 
-		if t.LocalBindPort == 0 {
-			log.Printf("ERROR tunnel %s: missing local_bind_port, skip.", name)
+		// tunnel name is key for control and reload.
+		if _, exists := names[name]; exists {
+			slog.Error("duplicate tunnel name, skip.", mogura.LOG_KEY_TUNNEL, name)
 			continue
 		}
 
-		// duplicate port check
-		_, exists := portMap[t.LocalBindPort]
-		if exists {
-			log.Printf("ERROR tunnel %s: duplicate local_bind_port %d, skip.", name, t.LocalBindPort)
+		if t.LocalBindSocket != "" {
+			if _, exists := socketMap[t.LocalBindSocket]; exists {
+				slog.Error("duplicate local_bind_socket, skip.", mogura.LOG_KEY_TUNNEL, name, "local_bind_socket", t.LocalBindSocket)
+				continue
+			}
+			socketMap[t.LocalBindSocket] = struct{}{}
+		} else if t.Direction == "" || t.Direction == mogura.DIRECTION_LOCAL {
+			if t.LocalBindAddress == LOCAL_BIND_ADDRESS_AUTO {
+				address, err := allocator.allocate(name)
+				if err != nil {
+					slog.Error("invalid tunnel, skip.", mogura.LOG_KEY_TUNNEL, name, mogura.LOG_KEY_ERROR, err)
+					continue
+				}
+				t.LocalBindAddress = address
+			}
+
+			// duplicate port check. different local addresses can use same port.
+			address := normalizeLocalAddress(t.LocalBindAddress)
+			conflicted := false
+			for _, bound := range portMap[t.LocalBindPort] {
+				if localBindConflicts(address, bound) {
+					conflicted = true
+					break
+				}
+			}
+			if conflicted {
+				slog.Error("duplicate local_bind_port, skip.", mogura.LOG_KEY_TUNNEL, name, "local_bind_address", address, "local_bind_port", t.LocalBindPort)
+				continue
+			} else if t.LocalBindPort != 0 {
+				portMap[t.LocalBindPort] = append(portMap[t.LocalBindPort], address)
+			}
+		}
+
+		tun, err := newTunnel(name, t, c, basConfigs, basDNS, resolve)
+		if err != nil {
+			slog.Error("invalid tunnel, skip.", mogura.LOG_KEY_TUNNEL, name, mogura.LOG_KEY_ERROR, err)
 			continue
-		} else {
-			portMap[t.LocalBindPort] = struct{}{}
 		}
 
-		localHostPort := localport(t.LocalBindPort)
+		names[name] = struct{}{}
+		tunnels = append(tunnels, tun)
+	}
 
-		forwardingTimeoutDuration := DEFAULT_FORWARDING_TIMEOUT
-		if t.ForwardingTimeout != "" {
-			d, parseErr := time.ParseDuration(t.ForwardingTimeout)
-			if parseErr != nil {
-				log.Printf("WARN tunnel %s: target forwarding timeout format is invalid: %v, set default time %v", name, parseErr, DEFAULT_FORWARDING_TIMEOUT)
-			} else {
-				forwardingTimeoutDuration = d
-			}
+	return tunnels, nil
+}
+
+// newTunnel validates tunnel config and builds tunnel settings.
+func newTunnel(name string, t TunnelConfig, c *Config, basConfigs map[string]mogura.BastionConfig, basDNS map[string]mogura.DNSOptions, resolve mogura.ResolveOptions) (*tunnel, error) {
+	// keep original for comparing
+	original := t
+
+	switch t.Direction {
+	case "", mogura.DIRECTION_LOCAL:
+		if t.LocalBindPort == 0 && t.LocalBindSocket == "" {
+			return nil, fmt.Errorf("missing local_bind_port")
 		}
 
-		target := mogura.Target{
-			TargetType:        t.TargetType,
-			Target:            t.Target,
-			TargetPort:        t.TargetPort,
-			ForwardingTimeout: forwardingTimeoutDuration,
+		if t.LocalBindPort != 0 && t.LocalBindSocket != "" {
+			return nil, fmt.Errorf("local_bind_port and local_bind_socket can not be used together")
 		}
+	case mogura.DIRECTION_REMOTE:
+		if t.RemoteBindPort == 0 {
+			return nil, fmt.Errorf("missing remote_bind_port")
+		}
+
+		if t.Type == mogura.TUNNEL_TYPE_SOCKS5 {
+			return nil, fmt.Errorf("direction remote does not support type socks5")
+		}
+
+		if t.LocalBindSocket != "" {
+			return nil, fmt.Errorf("direction remote does not support local_bind_socket")
+		}
+
+		// target is in local.
+		if t.Target == "" && t.TargetSocket == "" {
+			t.Target = DEFAULT_LOCAL_TARGET
+		}
+	default:
+		return nil, fmt.Errorf("invalid direction %s", t.Direction)
+	}
+
+	basKey := t.Bastion
+	if basKey == "" {
+		defaultKey, err := c.DefaultBastion()
+		if err != nil {
+			return nil, err
+		}
+		basKey = defaultKey
+	}
+
+	basConfig, exists := basConfigs[basKey]
+	if !exists {
+		return nil, fmt.Errorf("bastion %s is not found in bastions", basKey)
+	}
+	remoteDNS := basDNS[basKey]
+
+	if t.LocalBindAddress != "" && t.LocalBindAddress != "localhost" && net.ParseIP(t.LocalBindAddress) == nil {
+		return nil, fmt.Errorf("invalid local_bind_address %s. IP address, localhost or auto.", t.LocalBindAddress)
+	}
+	localHostPort := localBindHostPort(t.LocalBindAddress, t.LocalBindPort)
+
+	localSocket := ""
+	if t.LocalBindSocket != "" {
+		s, err := ResolveUserHome(t.LocalBindSocket)
+		if err != nil {
+			return nil, fmt.Errorf("can not resolved user home path in %s: %v", t.LocalBindSocket, err)
+		}
+		localSocket = s
+		localHostPort = ""
+	}
+
+	forwarding := mogura.ForwardingOptions{
+		IdleTimeout: parseDurationOption(name, "idle_timeout", t.IdleTimeout),
+		MaxLifetime: parseDurationOption(name, "max_lifetime", t.MaxLifetime),
+	}
+
+	// forwarding_timeout was absolute timeout, so it is same as max_lifetime.
+	if t.ForwardingTimeout != "" {
+		slog.Warn("forwarding_timeout is deprecated, use idle_timeout or max_lifetime.", mogura.LOG_KEY_TUNNEL, name)
+		if forwarding.MaxLifetime == 0 {
+			forwarding.MaxLifetime = parseDurationOption(name, "forwarding_timeout", t.ForwardingTimeout)
+		}
+	}
+
+	target := mogura.Target{
+		TargetType: t.TargetType,
+		Target:     t.Target,
+		TargetPort: t.TargetPort,
+		IPFamily:   t.IPFamily,
+	}
+
+	if t.TargetSocket != "" {
+		if t.Target != "" || t.TargetPort != 0 || t.TargetType != "" {
+			return nil, fmt.Errorf("target_socket can not be used with target, target_port and target_type")
+		}
+
+		target = mogura.Target{
+			TargetType: mogura.TARGET_TYPE_UNIX,
+			Target:     t.TargetSocket,
+		}
+	}
+
+	moguraConfig := mogura.MoguraConfig{
+		Name:             basConfig.Name + " -> " + name,
+		Tunnel:           name,
+		LocalBindPort:    localHostPort,
+		LocalBindSocket:  localSocket,
+		RemoteDNS:        remoteDNS,
+		ForwardingTarget: target,
+		LoadBalance:      t.LoadBalance,
+		Forwarding:       forwarding,
+		Resolve:          resolve,
+	}
+
+	if t.ResolveInterval != "" {
+		d, err := time.ParseDuration(t.ResolveInterval)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid resolve_interval %s", t.ResolveInterval)
+		}
+		moguraConfig.Resolve.Interval = d
+	}
+
+	forwardingTarget := target.HostPort()
+	if t.TargetPort == 0 {
+		// SRV
+		forwardingTarget = target.Target
+	}
+
+	switch t.Type {
+	case mogura.TUNNEL_TYPE_SOCKS5:
+		if t.TargetSocket != "" {
+			return nil, fmt.Errorf("type socks5 does not support target_socket")
+		}
+
+		if t.Socks5RemoteDNS && !remoteDNS.Enabled() {
+			return nil, fmt.Errorf("remote_dns is required when socks5_remote_dns is true")
+		}
+
+		if t.Socks5Username == "" && t.Socks5Password != "" {
+			return nil, fmt.Errorf("socks5_username is required when socks5_password is set")
+		}
+
+		moguraConfig.TunnelType = mogura.TUNNEL_TYPE_SOCKS5
+		moguraConfig.Socks5 = mogura.Socks5Config{
+			Username:     t.Socks5Username,
+			Password:     t.Socks5Password,
+			UseRemoteDNS: t.Socks5RemoteDNS,
+		}
+		forwardingTarget = "(socks5 dynamic)"
+	case "", mogura.TUNNEL_TYPE_FORWARD:
 		err := target.Validate()
 		if err != nil {
-			log.Printf("ERROR tunnel %s: invalid tunnel target: %v, skip.", name, err)
-			continue
+			return nil, fmt.Errorf("invalid tunnel target: %v", err)
 		}
 
 		if t.TargetType == "SRV" {
-			if c.Bastion.RemoteDNS == "" {
-				log.Printf("ERROR tunnel %s: remote_dns is required when target type is SRV, skip.", name)
-				continue
+			if !remoteDNS.Enabled() {
+				return nil, fmt.Errorf("remote_dns is required when target type is SRV")
 			}
 		}
-		moguraConfig := mogura.MoguraConfig{
-			Name:             basName + " -> " + name,
-			BastionHostPort:  bastionHostPort,
-			Username:         c.Bastion.User,
-			KeyPath:          rKeyPath,
-			LocalBindPort:    localHostPort,
-			RemoteDNS:        c.Bastion.RemoteDNS,
-			ForwardingTarget: target,
+		moguraConfig.TunnelType = mogura.TUNNEL_TYPE_FORWARD
+
+		if t.Direction == mogura.DIRECTION_REMOTE {
+			if t.TargetType != "" {
+				return nil, fmt.Errorf("direction remote does not support target_type")
+			}
+
+			remoteBindAddress := t.RemoteBindAddress
+			if remoteBindAddress == "" {
+				remoteBindAddress = DEFAULT_REMOTE_BIND_ADDRESS
+			}
+
+			moguraConfig.Direction = mogura.DIRECTION_REMOTE
+			moguraConfig.RemoteBindAddress = hostport(remoteBindAddress, t.RemoteBindPort)
 		}
+	default:
+		return nil, fmt.Errorf("invalid type %s", t.Type)
+	}
 
-		forwardingTarget := t.Target
-		if t.TargetPort > 0 {
-			forwardingTarget += ":" + strconv.Itoa(t.TargetPort)
+	var route string
+	if moguraConfig.Direction == mogura.DIRECTION_REMOTE {
+		route = fmt.Sprintf("%s (local) <- %s <- %s (remote)%s", forwardingTarget, basConfig.Route(), moguraConfig.RemoteBindAddress, forwardingLimits(forwarding))
+	} else {
+		local := localHostPort
+		if localSocket != "" {
+			local = localSocket
 		}
-		log.Printf("starting tunnel %s", moguraConfig.Name)
-		log.Printf("%s -> %s -> %s with forwarding timeout %v", localHostPort, bastionHostPort, forwardingTarget, forwardingTimeoutDuration)
-		mogura, err := mogura.GoMogura(moguraConfig)
-		if err != nil {
-			/*
-				TODO retry and error handling with other connection closing.
-				currently, user self stop and connection not close handling...
-			*/
-			log.Printf("start %s tunnel failed: %v", t.Name, err)
+		route = fmt.Sprintf("%s -> %s -> %s%s", local, basConfig.Route(), forwardingTarget, forwardingLimits(forwarding))
+	}
 
-			continue
+	return &tunnel{
+		name:    name,
+		config:  original,
+		bastion: basConfig,
+		mogura:  moguraConfig,
+		route:   route,
+	}, nil
+}
+
+// runCommand runs subcommand to running mogura, and returns exit code.
+func runCommand(confPath, command string, args []string) int {
+	socketPath := GetDefaultControlSocketPath()
+	// config is optional for commands.
+	if c, err := LoadConfig(confPath); err == nil {
+		socketPath = c.GetControlSocketPath()
+	}
+
+	var err error
+	switch command {
+	case "status":
+		err = runStatus(socketPath)
+	case "events":
+		err = runEvents(socketPath)
+	case "up", "down", "restart":
+		err = runTunnelCommand(socketPath, command, args)
+	default:
+		usage()
+		return 1
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// resolveJumps builds jump hosts. empty user, key and auth are inherited from bastion.
+func resolveJumps(jc []JumpConfig, basUser, basKeyPath string, basUseAgent, agentTryAll bool, knownHostsPath string, trustOnFirstUse bool) ([]mogura.SSHHop, error) {
+	hops := make([]mogura.SSHHop, 0, len(jc))
+	for i, j := range jc {
+		if j.Host == "" {
+			return nil, fmt.Errorf("jump %d: host is required.", i+1)
+		}
+
+		port := j.Port
+		if port == 0 {
+			port = 22
+		}
+
+		user := j.User
+		if user == "" {
+			user = basUser
+		}
+
+		useAgent := basUseAgent
+		switch j.Auth {
+		case "":
+		case AUTH_KEY:
+			useAgent = false
+		case AUTH_AGENT:
+			useAgent = true
+		default:
+			return nil, fmt.Errorf("jump %d: invalid auth %s.", i+1, j.Auth)
 		}
 
-		// show transfer error
-		go func(t TunnelConfig) {
-			for tErr := range mogura.ErrChan() {
-				/*
-				 TODO if too many got error then reconnection?
-				 use mogura.ConnectSSH(), mogura.ResolveRemote(), mogura.Listen()
-				*/
-				log.Printf("%s tunnel transfer failed: %v", t.Name, tErr)
+		keyPath := basKeyPath
+		if j.KeyPath != "" {
+			rKeyPath, err := ResolveUserHome(j.KeyPath)
+			if err != nil {
+				return nil, fmt.Errorf("jump %d: can not resolved user home path in %s: %v", i+1, j.KeyPath, err)
 			}
-		}(t)
+			keyPath = rKeyPath
+		}
 
-		openedTunnelCount++
-		// set map for control
-		moguraMap[t.Name] = mogura
-		log.Printf("started tunnel %s", mogura.Config.Name)
+		hops = append(hops, mogura.SSHHop{
+			HostPort:        hostport(j.Host, port),
+			Username:        user,
+			KeyPath:         keyPath,
+			UseAgent:        useAgent,
+			AgentTryAll:     agentTryAll,
+			KnownHostsPath:  knownHostsPath,
+			TrustOnFirstUse: trustOnFirstUse,
+		})
 	}
 
-	// all tunnel is wrong
-	if openedTunnelCount == 0 {
-		log.Fatalf("all tunnels are invalid. mogura was not started.")
+	return hops, nil
+}
+
+// resolveBastion builds bastion connection setting with default values.
+func resolveBastion(sc SSHConfig) (mogura.BastionConfig, error) {
+	// default name is Bastion
+	basName := sc.Name
+	if basName == "" {
+		basName = "Bastion"
 	}
 
-	if openedTunnelCount < len(c.Tunnels) {
-		log.Printf("some tunnels are invalid. those tunnel were not started.")
+	if sc.Host == "" {
+		return mogura.BastionConfig{}, fmt.Errorf("bastion host is required.")
 	}
 
-	log.Printf("mogura is started. mogura stop with press Ctrl+C")
+	// default port 22(ssh default)
+	basPort := sc.Port
+	if basPort == 0 {
+		basPort = 22
+	}
 
-	// Create a context that will be canceled on SIGINT
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
-	defer stop()
+	useAgent := false
+	switch sc.Auth {
+	case "", AUTH_KEY:
+	case AUTH_AGENT:
+		useAgent = true
+	default:
+		return mogura.BastionConfig{}, fmt.Errorf("invalid auth %s. it must be %s or %s.", sc.Auth, AUTH_KEY, AUTH_AGENT)
+	}
 
-	// Wait for the interrupt signal
-	<-ctx.Done()
-	log.Printf("stopping mogura because got signal...")
-	for n, m := range moguraMap {
-		m.Close()
-		log.Printf("closed %s tunnel.", n)
+	// default key path "~/.ssh/id_rsa". key file is optional fallback when use agent.
+	basKeyPath := sc.KeyPath
+	if basKeyPath == "" && !useAgent {
+		basKeyPath = "~/.ssh/id_rsa"
 	}
-	log.Printf("stopped mogura.")
+
+	// resolved "~/"
+	rKeyPath, err := ResolveUserHome(basKeyPath)
+	if err != nil {
+		return mogura.BastionConfig{}, fmt.Errorf("can not resolved user home path in %s: %v", basKeyPath, err)
+	}
+
+	// default known_hosts path "~/.ssh/known_hosts"
+	basKnownHosts := sc.KnownHosts
+	if basKnownHosts == "" {
+		basKnownHosts = DEFAULT_KNOWN_HOSTS_PATH
+	}
+
+	rKnownHosts, err := ResolveUserHome(basKnownHosts)
+	if err != nil {
+		return mogura.BastionConfig{}, fmt.Errorf("can not resolved user home path in %s: %v", basKnownHosts, err)
+	}
+
+	// default strict host key checking
+	trustOnFirstUse := false
+	switch sc.HostKeyCheck {
+	case "", HOST_KEY_CHECK_STRICT:
+	case HOST_KEY_CHECK_TOFU:
+		trustOnFirstUse = true
+	default:
+		return mogura.BastionConfig{}, fmt.Errorf("invalid host_key_check %s. it must be %s or %s.", sc.HostKeyCheck, HOST_KEY_CHECK_STRICT, HOST_KEY_CHECK_TOFU)
+	}
+
+	jumps, err := resolveJumps(sc.Jump, sc.User, rKeyPath, useAgent, sc.AgentTryAll, rKnownHosts, trustOnFirstUse)
+	if err != nil {
+		return mogura.BastionConfig{}, fmt.Errorf("invalid jump setting: %v", err)
+	}
+
+	var keepaliveInterval time.Duration
+	if sc.KeepaliveInterval != "" {
+		keepaliveInterval, err = time.ParseDuration(sc.KeepaliveInterval)
+		if err != nil || keepaliveInterval < 0 {
+			return mogura.BastionConfig{}, fmt.Errorf("invalid keepalive_interval %s.", sc.KeepaliveInterval)
+		}
+	}
+
+	if sc.KeepaliveCountMax < 0 {
+		return mogura.BastionConfig{}, fmt.Errorf("invalid keepalive_count_max %d.", sc.KeepaliveCountMax)
+	}
+
+	return mogura.BastionConfig{
+		Name:              basName,
+		KeepaliveInterval: keepaliveInterval,
+		KeepaliveCountMax: sc.KeepaliveCountMax,
+		Jumps:             jumps,
+		Bastion: mogura.SSHHop{
+			HostPort:        hostport(sc.Host, basPort),
+			Username:        sc.User,
+			KeyPath:         rKeyPath,
+			UseAgent:        useAgent,
+			AgentTryAll:     sc.AgentTryAll,
+			KnownHostsPath:  rKnownHosts,
+			TrustOnFirstUse: trustOnFirstUse,
+		},
+	}, nil
+}
+
+// parseDurationOption parses duration option. invalid format is no limit with warning.
+func parseDurationOption(tunnelName, option, value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		slog.Warn("duration format is invalid, set no limit.", mogura.LOG_KEY_TUNNEL, tunnelName, "option", option, mogura.LOG_KEY_ERROR, err)
+		return 0
+	}
+
+	return d
+}
+
+func forwardingLimits(opts mogura.ForwardingOptions) string {
+	limits := ""
+	if opts.IdleTimeout > 0 {
+		limits += fmt.Sprintf(" with idle timeout %v", opts.IdleTimeout)
+	}
+	if opts.MaxLifetime > 0 {
+		if limits == "" {
+			limits += " with"
+		} else {
+			limits += " and"
+		}
+		limits += fmt.Sprintf(" max lifetime %v", opts.MaxLifetime)
+	}
+
+	return limits
 }
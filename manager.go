@@ -0,0 +1,534 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/reiki4040/mogura/mogura"
+)
+
+const (
+	TUNNEL_STATE_STARTING = "starting"
+	TUNNEL_STATE_UP       = "up"
+	TUNNEL_STATE_RETRYING = "retrying"
+	// gave up retrying over max attempts
+	TUNNEL_STATE_FAILED = "failed"
+	TUNNEL_STATE_DOWN   = "down"
+)
+
+var (
+	ErrTunnelNotFound = errors.New("tunnel is not found")
+)
+
+// tunnel is validated tunnel setting. running is nil when the tunnel is not up.
+type tunnel struct {
+	name    string
+	config  TunnelConfig
+	bastion mogura.BastionConfig
+	mogura  mogura.MoguraConfig
+	// route for log
+	route string
+
+	// serialize up/down of this tunnel
+	opMutex sync.Mutex
+
+	// protected by manager mutex
+	state       string
+	running     *mogura.Mogura
+	lastError   string
+	lastErrorAt time.Time
+	// closed when retrying is canceled
+	retryCancel chan struct{}
+}
+
+// TunnelManager starts and stops tunnels individually.
+// tunnel that failed to start is retried with backoff.
+type TunnelManager struct {
+	pool    *mogura.BastionPool
+	backoff mogura.Backoff
+	events  *EventLog
+
+	mutex   sync.Mutex
+	tunnels map[string]*tunnel
+	// config order
+	order []string
+}
+
+func NewTunnelManager(pool *mogura.BastionPool, backoff mogura.Backoff, events *EventLog) *TunnelManager {
+	return &TunnelManager{
+		pool:    pool,
+		backoff: backoff,
+		events:  events,
+		tunnels: make(map[string]*tunnel),
+	}
+}
+
+// Add registers the tunnel as down.
+func (tm *TunnelManager) Add(t *tunnel) error {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	if _, exists := tm.tunnels[t.name]; exists {
+		return fmt.Errorf("duplicate tunnel name %s", t.name)
+	}
+	t.state = TUNNEL_STATE_DOWN
+	tm.tunnels[t.name] = t
+	tm.order = append(tm.order, t.name)
+
+	return nil
+}
+
+func (tm *TunnelManager) get(name string) (*tunnel, error) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	t, exists := tm.tunnels[name]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrTunnelNotFound, name)
+	}
+
+	return t, nil
+}
+
+// Up starts the tunnel. if it failed, then retries in background and returns the error.
+func (tm *TunnelManager) Up(name string) error {
+	t, err := tm.get(name)
+	if err != nil {
+		return err
+	}
+
+	t.opMutex.Lock()
+	defer t.opMutex.Unlock()
+
+	return tm.up(t)
+}
+
+// Down stops the tunnel and its retrying. other tunnels on same bastion are not affected.
+func (tm *TunnelManager) Down(name string) error {
+	t, err := tm.get(name)
+	if err != nil {
+		return err
+	}
+
+	t.opMutex.Lock()
+	defer t.opMutex.Unlock()
+
+	return tm.down(t)
+}
+
+// Restart stops the tunnel if it is up, and starts it.
+func (tm *TunnelManager) Restart(name string) error {
+	t, err := tm.get(name)
+	if err != nil {
+		return err
+	}
+
+	t.opMutex.Lock()
+	defer t.opMutex.Unlock()
+
+	if tm.isUp(t) {
+		err := tm.down(t)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tm.up(t)
+}
+
+func (tm *TunnelManager) isUp(t *tunnel) bool {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	return t.running != nil
+}
+
+// setState changes tunnel state and records event. must be called with manager mutex.
+func (tm *TunnelManager) setState(t *tunnel, state string, attempt int, nextRetry time.Duration, err error) {
+	if t.state == state && state != TUNNEL_STATE_RETRYING {
+		return
+	}
+	t.state = state
+
+	e := Event{
+		Time:    time.Now(),
+		Tunnel:  t.name,
+		Bastion: t.bastion.Name,
+		State:   state,
+		Attempt: attempt,
+	}
+	if nextRetry > 0 {
+		e.NextRetry = nextRetry.Round(time.Millisecond).String()
+	}
+	if err != nil {
+		e.Error = err.Error()
+		t.lastError = e.Error
+		t.lastErrorAt = e.Time
+	}
+	tm.events.Add(e)
+}
+
+// up must be called with tunnel opMutex.
+func (tm *TunnelManager) up(t *tunnel) error {
+	if tm.isUp(t) {
+		return fmt.Errorf("tunnel %s is already up.", t.name)
+	}
+	tm.stopRetry(t)
+
+	slog.Info("starting tunnel", mogura.LOG_KEY_TUNNEL, t.name, mogura.LOG_KEY_BASTION, t.bastion.Name, "route", t.route)
+	tm.mutex.Lock()
+	tm.setState(t, TUNNEL_STATE_STARTING, 0, 0, nil)
+	tm.mutex.Unlock()
+
+	m, err := tm.start(t)
+	if err != nil {
+		tm.retry(t, err)
+		return err
+	}
+
+	tm.mutex.Lock()
+	t.running = m
+	tm.setState(t, TUNNEL_STATE_UP, 0, 0, nil)
+	tm.mutex.Unlock()
+	go tm.watchClosed(t, m)
+
+	slog.Info("started tunnel", mogura.LOG_KEY_TUNNEL, t.name, mogura.LOG_KEY_BASTION, t.bastion.Name)
+	return nil
+}
+
+// watchClosed retries the tunnel when running tunnel closed itself (ex. forwarding is prohibited, listener is broken).
+func (tm *TunnelManager) watchClosed(t *tunnel, m *mogura.Mogura) {
+	<-m.Done()
+
+	t.opMutex.Lock()
+	defer t.opMutex.Unlock()
+
+	tm.mutex.Lock()
+	// closed by down, restart or reload.
+	if t.running != m {
+		tm.mutex.Unlock()
+		return
+	}
+	t.running = nil
+	tm.mutex.Unlock()
+
+	err := fmt.Errorf("tunnel closed unexpectedly.")
+	if lastError := m.Stats().LastError; lastError != "" {
+		err = fmt.Errorf("tunnel closed unexpectedly: %s", lastError)
+	}
+	slog.Warn("tunnel closed, retrying", mogura.LOG_KEY_TUNNEL, t.name, mogura.LOG_KEY_BASTION, t.bastion.Name, mogura.LOG_KEY_ERROR, err)
+	tm.retry(t, err)
+}
+
+// retry starts retrying in background. must be called with tunnel opMutex.
+func (tm *TunnelManager) retry(t *tunnel, err error) {
+	cancel := make(chan struct{})
+	tm.mutex.Lock()
+	t.retryCancel = cancel
+	tm.mutex.Unlock()
+
+	go tm.superviseStart(t, cancel, err)
+}
+
+// superviseStart retries starting the tunnel with backoff until succeeded, max attempts or canceled.
+func (tm *TunnelManager) superviseStart(t *tunnel, cancel chan struct{}, lastErr error) {
+	for attempt := 1; ; attempt++ {
+		if tm.backoff.Exceeded(attempt) {
+			tm.mutex.Lock()
+			tm.setState(t, TUNNEL_STATE_FAILED, attempt-1, 0, lastErr)
+			tm.mutex.Unlock()
+			return
+		}
+
+		wait := tm.backoff.Interval(attempt)
+		tm.mutex.Lock()
+		tm.setState(t, TUNNEL_STATE_RETRYING, attempt, wait, lastErr)
+		tm.mutex.Unlock()
+
+		select {
+		case <-cancel:
+			return
+		case <-time.After(wait):
+		}
+
+		t.opMutex.Lock()
+		select {
+		case <-cancel:
+			// down or up by user while waiting lock.
+			t.opMutex.Unlock()
+			return
+		default:
+		}
+
+		m, err := tm.start(t)
+		if err == nil {
+			tm.mutex.Lock()
+			t.running = m
+			t.retryCancel = nil
+			tm.setState(t, TUNNEL_STATE_UP, attempt, 0, nil)
+			tm.mutex.Unlock()
+			t.opMutex.Unlock()
+			go tm.watchClosed(t, m)
+
+			slog.Info("started tunnel", mogura.LOG_KEY_TUNNEL, t.name, mogura.LOG_KEY_BASTION, t.bastion.Name, "attempt", attempt)
+			return
+		}
+		t.opMutex.Unlock()
+		lastErr = err
+	}
+}
+
+// stopRetry cancels retrying. must be called with tunnel opMutex.
+func (tm *TunnelManager) stopRetry(t *tunnel) bool {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	if t.retryCancel == nil {
+		return false
+	}
+
+	close(t.retryCancel)
+	t.retryCancel = nil
+	return true
+}
+
+func (tm *TunnelManager) start(t *tunnel) (*mogura.Mogura, error) {
+	bastion, err := tm.pool.Acquire(t.bastion)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := mogura.GoMogura(t.mogura, bastion)
+	if err != nil {
+		return nil, err
+	}
+
+	// show transfer error
+	go func(name, bastion string) {
+		for tErr := range m.ErrChan() {
+			slog.Error("tunnel transfer failed", mogura.LOG_KEY_TUNNEL, name, mogura.LOG_KEY_BASTION, bastion, mogura.LOG_KEY_ERROR, tErr)
+		}
+	}(t.name, t.bastion.Name)
+
+	return m, nil
+}
+
+// down must be called with tunnel opMutex.
+func (tm *TunnelManager) down(t *tunnel) error {
+	retrying := tm.stopRetry(t)
+
+	tm.mutex.Lock()
+	m := t.running
+	t.running = nil
+	tm.setState(t, TUNNEL_STATE_DOWN, 0, 0, nil)
+	tm.mutex.Unlock()
+
+	if m == nil {
+		if retrying {
+			return nil
+		}
+		return fmt.Errorf("tunnel %s is already down.", t.name)
+	}
+
+	err := m.Close()
+	if err != nil {
+		slog.Warn("close tunnel failed", mogura.LOG_KEY_TUNNEL, t.name, mogura.LOG_KEY_ERROR, err)
+	}
+	slog.Info("closed tunnel.", mogura.LOG_KEY_TUNNEL, t.name)
+
+	return nil
+}
+
+// UpAll starts all tunnels, and returns count of started tunnels. failed tunnels are retried in background.
+func (tm *TunnelManager) UpAll() int {
+	started := 0
+	for _, name := range tm.names() {
+		err := tm.Up(name)
+		if err != nil {
+			slog.Error("start tunnel failed", mogura.LOG_KEY_TUNNEL, name, mogura.LOG_KEY_ERROR, err)
+			continue
+		}
+		started++
+	}
+
+	return started
+}
+
+// CloseAll stops all running tunnels and retrying.
+func (tm *TunnelManager) CloseAll() {
+	for _, name := range tm.names() {
+		t, err := tm.get(name)
+		if err != nil {
+			continue
+		}
+
+		t.opMutex.Lock()
+		tm.down(t)
+		t.opMutex.Unlock()
+	}
+}
+
+func (tm *TunnelManager) names() []string {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	names := make([]string, len(tm.order))
+	copy(names, tm.order)
+
+	return names
+}
+
+// sameSetting returns whether tunnel settings are not changed.
+func (t *tunnel) sameSetting(other *tunnel) bool {
+	return reflect.DeepEqual(t.config, other.config) &&
+		reflect.DeepEqual(t.bastion, other.bastion) &&
+		reflect.DeepEqual(t.mogura, other.mogura)
+}
+
+// Reload replaces tunnels with new settings. new and changed tunnels are started, removed and changed tunnels are stopped.
+// unchanged tunnels are kept as is (up or down), so their connections are not affected.
+func (tm *TunnelManager) Reload(tunnels []*tunnel) {
+	tm.mutex.Lock()
+	newTunnels := make(map[string]*tunnel, len(tunnels))
+	order := make([]string, 0, len(tunnels))
+	starting := make([]*tunnel, 0)
+	for _, t := range tunnels {
+		current, exists := tm.tunnels[t.name]
+		if exists && current.sameSetting(t) {
+			newTunnels[t.name] = current
+		} else {
+			newTunnels[t.name] = t
+			starting = append(starting, t)
+		}
+		order = append(order, t.name)
+	}
+
+	stopping := make([]*tunnel, 0)
+	for name, current := range tm.tunnels {
+		if newTunnels[name] != current {
+			stopping = append(stopping, current)
+		}
+	}
+
+	tm.tunnels = newTunnels
+	tm.order = order
+	tm.mutex.Unlock()
+
+	// stop first, then changed bastion connection is closed before starting with new setting.
+	for _, t := range stopping {
+		t.opMutex.Lock()
+		tm.down(t)
+		t.opMutex.Unlock()
+		slog.Info("tunnel is removed or changed.", mogura.LOG_KEY_TUNNEL, t.name)
+	}
+
+	for _, t := range starting {
+		err := tm.Up(t.name)
+		if err != nil {
+			slog.Error("start tunnel failed", mogura.LOG_KEY_TUNNEL, t.name, mogura.LOG_KEY_ERROR, err)
+		}
+	}
+
+	slog.Info("reloaded tunnels", "started", len(starting), "stopped", len(stopping), "unchanged", len(tunnels)-len(starting))
+}
+
+// Statuses returns all tunnels status including down tunnels.
+func (tm *TunnelManager) Statuses() []TunnelStatus {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	statuses := make([]TunnelStatus, 0, len(tm.tunnels))
+	for name, t := range tm.tunnels {
+		if t.running != nil {
+			statuses = append(statuses, TunnelStatus{
+				Tunnel: name,
+				State:  t.state,
+				Stats:  t.running.Stats(),
+			})
+			continue
+		}
+
+		statuses = append(statuses, TunnelStatus{
+			Tunnel: name,
+			State:  t.state,
+			Stats: mogura.Stats{
+				Name:              t.mogura.Name,
+				Bastion:           t.bastion.Name,
+				BastionReconnects: tm.pool.Reconnects(t.bastion.Name),
+				LastError:         t.lastError,
+				LastErrorAt:       t.lastErrorAt,
+			},
+		})
+	}
+
+	return statuses
+}
+
+// Bastions returns all bastions that tunnels have used, including not connected bastions.
+func (tm *TunnelManager) Bastions() []mogura.BastionStats {
+	return tm.pool.Stats()
+}
+
+// LocalEndpoints returns local listening addresses of tunnels. remote direction tunnels do not have it.
+func (tm *TunnelManager) LocalEndpoints() []LocalEndpoint {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	endpoints := make([]LocalEndpoint, 0, len(tm.tunnels))
+	for _, name := range tm.order {
+		t := tm.tunnels[name]
+		if t.mogura.Direction == mogura.DIRECTION_REMOTE || t.mogura.LocalBindSocket != "" {
+			continue
+		}
+
+		endpoints = append(endpoints, LocalEndpoint{
+			Tunnel:  name,
+			Address: t.mogura.LocalBindPort,
+		})
+	}
+
+	return endpoints
+}
+
+// HostsEntries returns target hostnames and local bind addresses of forward tunnels.
+func (tm *TunnelManager) HostsEntries() []HostsEntry {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	endpoints := make([]HostsEntry, 0, len(tm.tunnels))
+	for _, name := range tm.order {
+		t := tm.tunnels[name]
+		c := t.mogura
+		if c.Direction == mogura.DIRECTION_REMOTE || c.TunnelType != mogura.TUNNEL_TYPE_FORWARD || c.LocalBindSocket != "" {
+			continue
+		}
+
+		// SRV name is not used by apps as hostname, and socket is not host.
+		if c.ForwardingTarget.NeedsResolve() || c.ForwardingTarget.TargetType == mogura.TARGET_TYPE_UNIX {
+			continue
+		}
+
+		host, _, err := net.SplitHostPort(c.LocalBindPort)
+		if err != nil {
+			continue
+		}
+
+		endpoints = append(endpoints, HostsEntry{
+			Tunnel:   name,
+			Hostname: c.ForwardingTarget.Target,
+			Address:  connectAddress(host),
+		})
+	}
+
+	return buildHostsEntries(endpoints)
+}
+
+// Events returns recent tunnel and bastion state transitions.
+func (tm *TunnelManager) Events() []Event {
+	return tm.events.Events()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/reiki4040/mogura/mogura"
+)
+
+// metric is Prometheus metric of tunnel stats.
+type metric struct {
+	name       string
+	metricType string
+	help       string
+	value      func(s TunnelStatus) int64
+}
+
+var tunnelMetrics = []metric{
+	{"mogura_tunnel_up", "gauge", "1 if the tunnel is up.", func(s TunnelStatus) int64 {
+		return boolToInt(s.State == TUNNEL_STATE_UP)
+	}},
+	{"mogura_connections_accepted_total", "counter", "accepted connections.", func(s TunnelStatus) int64 {
+		return s.TotalConnections
+	}},
+	{"mogura_connections_active", "gauge", "active forwarding connections.", func(s TunnelStatus) int64 {
+		return s.ActiveConnections
+	}},
+	{"mogura_bytes_sent_total", "counter", "bytes sent from local to remote.", func(s TunnelStatus) int64 {
+		return s.BytesSent
+	}},
+	{"mogura_bytes_received_total", "counter", "bytes received from remote to local.", func(s TunnelStatus) int64 {
+		return s.BytesReceived
+	}},
+	{"mogura_remote_dial_failures_total", "counter", "failed dials to forwarding target.", func(s TunnelStatus) int64 {
+		return s.DialFailures
+	}},
+	{"mogura_dns_resolve_failures_total", "counter", "failed target resolves with remote DNS.", func(s TunnelStatus) int64 {
+		return s.ResolveFailures
+	}},
+	{"mogura_target_changes_total", "counter", "resolved target changes.", func(s TunnelStatus) int64 {
+		return s.TargetChanges
+	}},
+	{"mogura_ssh_reconnects_total", "counter", "ssh reconnects of the bastion that the tunnel uses.", func(s TunnelStatus) int64 {
+		return s.BastionReconnects
+	}},
+}
+
+// bastionMetric is Prometheus metric of bastion. tunnels share the bastion, so it has only bastion label.
+type bastionMetric struct {
+	name       string
+	metricType string
+	help       string
+	value      func(s mogura.BastionStats) int64
+}
+
+var bastionMetrics = []bastionMetric{
+	{"mogura_bastion_connected", "gauge", "1 if the bastion ssh connection is alive.", func(s mogura.BastionStats) int64 {
+		return boolToInt(s.Connected)
+	}},
+	{"mogura_bastion_reconnects_total", "counter", "ssh reconnects of the bastion.", func(s mogura.BastionStats) int64 {
+		return s.Reconnects
+	}},
+}
+
+// MetricsSource is stats for metrics.
+type MetricsSource interface {
+	Statuses() []TunnelStatus
+	// all bastions whatever the tunnel state, so the bastion is visible during outage.
+	Bastions() []mogura.BastionStats
+}
+
+// MetricsServer serves tunnel metrics in Prometheus text format.
+type MetricsServer struct {
+	server *http.Server
+}
+
+func StartMetricsServer(addr string, source MetricsSource) (*MetricsServer, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("can not listen metrics %s: %v", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, source.Statuses(), source.Bastions())
+	})
+
+	ms := &MetricsServer{
+		server: &http.Server{Handler: mux},
+	}
+	go ms.server.Serve(l)
+
+	return ms, nil
+}
+
+func (ms *MetricsServer) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return ms.server.Shutdown(ctx)
+}
+
+func writeMetrics(w http.ResponseWriter, statuses []TunnelStatus, bastions []mogura.BastionStats) {
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Tunnel < statuses[j].Tunnel
+	})
+
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	for _, m := range tunnelMetrics {
+		writeMetricHeader(bw, m.name, m.metricType, m.help)
+		for _, s := range statuses {
+			fmt.Fprintf(bw, "%s{tunnel=\"%s\",bastion=\"%s\"} %d\n", m.name, escapeLabel(s.Tunnel), escapeLabel(s.Bastion), m.value(s))
+		}
+	}
+
+	for _, m := range bastionMetrics {
+		writeMetricHeader(bw, m.name, m.metricType, m.help)
+		for _, s := range bastions {
+			fmt.Fprintf(bw, "%s{bastion=\"%s\"} %d\n", m.name, escapeLabel(s.Name), m.value(s))
+		}
+	}
+}
+
+func writeMetricHeader(w *bufio.Writer, name, metricType, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func boolToInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,58 @@
+package mogura
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	DEFAULT_BACKOFF_INITIAL_INTERVAL = 1 * time.Second
+	DEFAULT_BACKOFF_MAX_INTERVAL     = 1 * time.Minute
+	DEFAULT_BACKOFF_MULTIPLIER       = 2.0
+	DEFAULT_BACKOFF_JITTER           = 0.2
+)
+
+// Backoff is exponential backoff setting for retrying.
+type Backoff struct {
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+	// randomization factor 0.0 - 1.0. interval is randomized in interval * (1 +- Jitter).
+	Jitter float64
+	// 0 is unlimited.
+	MaxAttempts int
+}
+
+func DefaultBackoff() Backoff {
+	return Backoff{
+		InitialInterval: DEFAULT_BACKOFF_INITIAL_INTERVAL,
+		MaxInterval:     DEFAULT_BACKOFF_MAX_INTERVAL,
+		Multiplier:      DEFAULT_BACKOFF_MULTIPLIER,
+		Jitter:          DEFAULT_BACKOFF_JITTER,
+	}
+}
+
+// Interval returns waiting time before the attempt. attempt starts with 1.
+func (b Backoff) Interval(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	interval := float64(b.InitialInterval) * math.Pow(b.Multiplier, float64(attempt-1))
+	if interval > float64(b.MaxInterval) {
+		interval = float64(b.MaxInterval)
+	}
+
+	if b.Jitter > 0 {
+		delta := b.Jitter * interval
+		interval = interval - delta + rand.Float64()*2*delta
+	}
+
+	return time.Duration(interval)
+}
+
+// Exceeded returns whether the attempt is over MaxAttempts.
+func (b Backoff) Exceeded(attempt int) bool {
+	return b.MaxAttempts > 0 && attempt > b.MaxAttempts
+}
@@ -0,0 +1,447 @@
+package mogura
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	KEEPALIVE_REQUEST           = "keepalive@openssh.com"
+	DEFAULT_KEEPALIVE_COUNT_MAX = 3
+)
+
+// BastionConfig is ssh connection setting to bastion.
+type BastionConfig struct {
+	Name string
+
+	// 0 is disabled.
+	KeepaliveInterval time.Duration
+	// 0 is DEFAULT_KEEPALIVE_COUNT_MAX
+	KeepaliveCountMax int
+
+	// jump hosts, connect in order before bastion.
+	Jumps   []SSHHop
+	Bastion SSHHop
+}
+
+// Hops returns jump hosts and bastion in connecting order.
+func (c BastionConfig) Hops() []SSHHop {
+	hops := make([]SSHHop, 0, len(c.Jumps)+1)
+	hops = append(hops, c.Jumps...)
+	return append(hops, c.Bastion)
+}
+
+// Route returns connecting route string for display.
+func (c BastionConfig) Route() string {
+	hostports := make([]string, 0, len(c.Jumps)+1)
+	for _, h := range c.Hops() {
+		hostports = append(hostports, h.HostPort)
+	}
+
+	return strings.Join(hostports, " -> ")
+}
+
+const (
+	BASTION_STATE_CONNECTED    = "connected"
+	BASTION_STATE_DISCONNECTED = "disconnected"
+	BASTION_STATE_RECONNECTING = "reconnecting"
+	BASTION_STATE_FAILED       = "failed"
+)
+
+// BastionEvent is state transition of bastion connection.
+type BastionEvent struct {
+	Bastion string
+	State   string
+	// reconnection attempt count
+	Attempt int
+	// waiting time before next attempt when State is BASTION_STATE_RECONNECTING
+	NextRetry time.Duration
+	// last error
+	Err error
+}
+
+// BastionPool shares one ssh connection per bastion across tunnels.
+type BastionPool struct {
+	mutex    sync.Mutex
+	bastions map[string]*Bastion
+	// reconnect counts by bastion name. it is kept after the bastion released,
+	// so the counter is not reset while all tunnels of the bastion are retrying.
+	reconnects map[string]*int64
+
+	// for reconnection when ssh connection is dead
+	backoff Backoff
+	onEvent func(BastionEvent)
+}
+
+// NewBastionPool creates pool. dead ssh connection is reconnected with backoff,
+// and onEvent is called when bastion state changed. onEvent can be nil.
+func NewBastionPool(backoff Backoff, onEvent func(BastionEvent)) *BastionPool {
+	return &BastionPool{
+		bastions:   make(map[string]*Bastion),
+		reconnects: make(map[string]*int64),
+		backoff:    backoff,
+		onEvent:    onEvent,
+	}
+}
+
+// BastionStats is snapshot of bastion state.
+type BastionStats struct {
+	Name       string
+	Connected  bool
+	Reconnects int64
+}
+
+// Stats returns all bastions that were acquired, including released bastions (not connected).
+func (p *BastionPool) Stats() []BastionStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	stats := make([]BastionStats, 0, len(p.reconnects))
+	for name, reconnects := range p.reconnects {
+		s := BastionStats{
+			Name:       name,
+			Reconnects: atomic.LoadInt64(reconnects),
+		}
+		if b, exists := p.bastions[name]; exists {
+			s.Connected = b.Connected()
+		}
+		stats = append(stats, s)
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+
+	return stats
+}
+
+// Reconnects returns count of reconnection of the bastion. it is not reset when the bastion released.
+func (p *BastionPool) Reconnects(name string) int64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if reconnects, exists := p.reconnects[name]; exists {
+		return atomic.LoadInt64(reconnects)
+	}
+
+	return 0
+}
+
+// Acquire returns connected bastion and increments reference count.
+// it connects ssh if the bastion is not connected yet. Release it when tunnel closed.
+// ssh connecting is out of pool lock, so unreachable bastion does not block other bastions.
+func (p *BastionPool) Acquire(c BastionConfig) (*Bastion, error) {
+	p.mutex.Lock()
+	b, exists := p.bastions[c.Name]
+	if !exists {
+		reconnects, counted := p.reconnects[c.Name]
+		if !counted {
+			reconnects = new(int64)
+			p.reconnects[c.Name] = reconnects
+		}
+
+		b = &Bastion{
+			Config:     c,
+			pool:       p,
+			done:       make(chan struct{}),
+			ready:      make(chan struct{}),
+			reconnects: reconnects,
+		}
+		p.bastions[c.Name] = b
+	}
+	b.refs++
+	p.mutex.Unlock()
+
+	if !exists {
+		b.connectErr = b.Reconnect(nil)
+		close(b.ready)
+	}
+
+	// other tunnels wait first connection.
+	<-b.ready
+	if b.connectErr != nil {
+		b.Release()
+		return nil, b.connectErr
+	}
+
+	return b, nil
+}
+
+// Bastion is ssh connection to bastion (and jump hosts) that is shared by tunnels.
+type Bastion struct {
+	Config BastionConfig
+
+	pool *BastionPool
+	// protected by pool mutex
+	refs int
+
+	// closed when first connection finished. connectErr is the result.
+	ready      chan struct{}
+	connectErr error
+
+	// protect clients switching
+	clientMutex sync.RWMutex
+	client      *ssh.Client
+	jumpClients []*ssh.Client
+	connected   bool
+
+	// only one reconnection at a time
+	reconnectMutex sync.Mutex
+	closed         bool
+	// closed when bastion closed
+	done chan struct{}
+	// waiting backoff interval for next reconnection
+	waiting int32
+
+	// count of reconnection after first connection, shared with pool by bastion name
+	reconnects *int64
+}
+
+// Client returns current ssh client. it returns nil if bastion is already closed.
+func (b *Bastion) Client() *ssh.Client {
+	b.clientMutex.RLock()
+	defer b.clientMutex.RUnlock()
+
+	return b.client
+}
+
+// Connected returns whether current ssh connection is alive.
+func (b *Bastion) Connected() bool {
+	b.clientMutex.RLock()
+	defer b.clientMutex.RUnlock()
+
+	return b.client != nil && b.connected
+}
+
+// watch marks disconnected when the client connection is closed, and starts reconnection.
+func (b *Bastion) watch(client *ssh.Client) {
+	client.Wait()
+
+	b.clientMutex.Lock()
+	dead := b.client == client
+	if dead {
+		b.connected = false
+	}
+	b.clientMutex.Unlock()
+
+	select {
+	case <-b.done:
+		// closed by mogura
+		return
+	default:
+	}
+
+	if dead {
+		b.superviseReconnect(client)
+	}
+}
+
+// superviseReconnect retries reconnection with backoff until succeeded, max attempts or bastion closed.
+// first attempt is immediate, because most disconnections are temporary.
+func (b *Bastion) superviseReconnect(failed *ssh.Client) {
+	b.emit(BastionEvent{State: BASTION_STATE_DISCONNECTED})
+
+	backoff := b.pool.backoff
+	var lastErr error
+	for attempt := 1; ; attempt++ {
+		if backoff.Exceeded(attempt) {
+			b.emit(BastionEvent{State: BASTION_STATE_FAILED, Attempt: attempt - 1, Err: lastErr})
+			return
+		}
+
+		var wait time.Duration
+		if attempt > 1 {
+			wait = backoff.Interval(attempt - 1)
+		}
+		b.emit(BastionEvent{State: BASTION_STATE_RECONNECTING, Attempt: attempt, NextRetry: wait, Err: lastErr})
+
+		// tunnels do not reconnect while waiting, so backoff works.
+		atomic.StoreInt32(&b.waiting, 1)
+		select {
+		case <-b.done:
+			atomic.StoreInt32(&b.waiting, 0)
+			return
+		case <-time.After(wait):
+		}
+		atomic.StoreInt32(&b.waiting, 0)
+
+		lastErr = b.reconnect(failed)
+		if lastErr == nil {
+			b.emit(BastionEvent{State: BASTION_STATE_CONNECTED, Attempt: attempt})
+			return
+		}
+	}
+}
+
+func (b *Bastion) emit(e BastionEvent) {
+	if b.pool.onEvent == nil {
+		return
+	}
+
+	e.Bastion = b.Config.Name
+	b.pool.onEvent(e)
+}
+
+// Reconnect rebuilds whole ssh connection chain and switches all tunnels to new connection.
+// failed is the client that caller got error, if it was already replaced by other tunnel's reconnection,
+// then does nothing. nil failed is always reconnect.
+// while waiting backoff interval of reconnection, it returns error without reconnection.
+func (b *Bastion) Reconnect(failed *ssh.Client) error {
+	if failed != nil && atomic.LoadInt32(&b.waiting) == 1 {
+		return fmt.Errorf("bastion %s is reconnecting.", b.Config.Name)
+	}
+
+	return b.reconnect(failed)
+}
+
+func (b *Bastion) reconnect(failed *ssh.Client) error {
+	b.reconnectMutex.Lock()
+	defer b.reconnectMutex.Unlock()
+
+	if b.closed {
+		return fmt.Errorf("bastion %s is already closed.", b.Config.Name)
+	}
+
+	if failed != nil && b.Client() != failed {
+		// already reconnected by other tunnel.
+		return nil
+	}
+
+	passphrase := os.Getenv(ENV_MOGURA_PASSPHRASE)
+	clients, err := DialChain(b.Config.Hops(), passphrase)
+	if err != nil {
+		return err
+	}
+
+	client := clients[len(clients)-1]
+	b.clientMutex.Lock()
+	oldClient := b.client
+	oldJumpClients := b.jumpClients
+	b.client = client
+	b.jumpClients = clients[:len(clients)-1]
+	b.connected = true
+	b.clientMutex.Unlock()
+	go b.watch(client)
+	if b.Config.KeepaliveInterval > 0 {
+		go b.keepalive(client)
+	}
+
+	// close current connection after switched new connection.
+	if oldClient != nil {
+		atomic.AddInt64(b.reconnects, 1)
+		oldClient.Close()
+	}
+	CloseChain(oldJumpClients)
+
+	return nil
+}
+
+// keepalive sends keepalive request on every interval without waiting reply, like ssh ServerAliveInterval.
+// when unanswered requests reach KeepaliveCountMax, the connection seems half-dead (ex. after sleep or network changed),
+// then closes it and watch reconnects. so dead connection is detected in about interval * KeepaliveCountMax.
+func (b *Bastion) keepalive(client *ssh.Client) {
+	interval := b.Config.KeepaliveInterval
+	countMax := b.Config.KeepaliveCountMax
+	if countMax <= 0 {
+		countMax = DEFAULT_KEEPALIVE_COUNT_MAX
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// unanswered requests are at most countMax, so senders never block after return.
+	replied := make(chan error, countMax)
+	unanswered := 0
+	for {
+		select {
+		case <-b.done:
+			return
+		case err := <-replied:
+			if err != nil {
+				// connection is closed, watch handles it.
+				return
+			}
+			// replies are in order, so any reply (even failure) means alive.
+			unanswered = 0
+			continue
+		case <-ticker.C:
+		}
+
+		if b.Client() != client {
+			// already replaced
+			return
+		}
+
+		if unanswered > 0 {
+			Logger().Warn("no keepalive reply", LOG_KEY_BASTION, b.Config.Name, "missed", unanswered)
+		}
+		if unanswered >= countMax {
+			Logger().Warn("bastion connection seems dead, reconnecting", LOG_KEY_BASTION, b.Config.Name)
+			client.Close()
+			return
+		}
+
+		unanswered++
+		go func() {
+			_, _, err := client.SendRequest(KEEPALIVE_REQUEST, true, nil)
+			replied <- err
+		}()
+	}
+}
+
+// Reconnects returns count of reconnection.
+func (b *Bastion) Reconnects() int64 {
+	return atomic.LoadInt64(b.reconnects)
+}
+
+// Release decrements reference count, and closes ssh connection when no tunnel uses it.
+func (b *Bastion) Release() error {
+	p := b.pool
+	p.mutex.Lock()
+	b.refs--
+	if b.refs > 0 {
+		p.mutex.Unlock()
+		return nil
+	}
+	// failed bastion may be replaced by new one already.
+	if p.bastions[b.Config.Name] == b {
+		delete(p.bastions, b.Config.Name)
+	}
+	p.mutex.Unlock()
+
+	return b.close()
+}
+
+func (b *Bastion) close() error {
+	// wait running reconnection.
+	b.reconnectMutex.Lock()
+	defer b.reconnectMutex.Unlock()
+	b.closed = true
+	close(b.done)
+
+	b.clientMutex.Lock()
+	client := b.client
+	jumpClients := b.jumpClients
+	b.client = nil
+	b.jumpClients = nil
+	b.clientMutex.Unlock()
+
+	if client == nil {
+		return nil
+	}
+
+	err := client.Close()
+	CloseChain(jumpClients)
+	if err != nil {
+		return fmt.Errorf("failed close ssh connection: %v", err)
+	}
+
+	return nil
+}
@@ -1,35 +1,161 @@
 package mogura
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
 	"golang.org/x/crypto/ssh"
 )
 
-func NewDNSClient(conn *ssh.Client, remoteDNS string) *DNSClient {
+const (
+	DNS_PROTOCOL_TCP = "tcp"
+	DNS_PROTOCOL_UDP = "udp"
+
+	DEFAULT_DNS_TIMEOUT = 2 * time.Second
+	// recommended EDNS0 buffer size by DNS flag day 2020.
+	DEFAULT_DNS_UDP_SIZE = 1232
+	// UDP can not be forwarded by ssh, so the helper in the bastion relays stdin/stdout to UDP.
+	// %s is replaced with resolver host:port, %h with host and %p with port. %% is %.
+	DEFAULT_DNS_UDP_HELPER = "socat -T2 - UDP:%s"
+
+	// helper prefix for direct-streamlocal. the unix socket in the bastion relays to UDP resolver.
+	DNS_UDP_HELPER_UNIX_PREFIX = "unix:"
+)
+
+// DNSOptions is remote DNS setting.
+type DNSOptions struct {
+	// resolver addresses (host:port) in the bastion network. tried in order when failed.
+	Resolvers []string
+
+	// DNS_PROTOCOL_TCP(default) or DNS_PROTOCOL_UDP. UDP retries with TCP when response is truncated.
+	Protocol string
+	// 0 is DEFAULT_DNS_TIMEOUT
+	Timeout time.Duration
+	// EDNS0 UDP buffer size. 0 is DEFAULT_DNS_UDP_SIZE
+	UDPSize uint16
+	// command in the bastion or "unix:/path/to/socket". empty is DEFAULT_DNS_UDP_HELPER
+	UDPHelper string
+}
+
+// Enabled returns whether remote DNS is configured.
+func (o DNSOptions) Enabled() bool {
+	return len(o.Resolvers) > 0
+}
+
+func (o DNSOptions) timeout() time.Duration {
+	if o.Timeout <= 0 {
+		return DEFAULT_DNS_TIMEOUT
+	}
+	return o.Timeout
+}
+
+func (o DNSOptions) udpSize() uint16 {
+	if o.UDPSize == 0 {
+		return DEFAULT_DNS_UDP_SIZE
+	}
+	return o.UDPSize
+}
+
+func NewDNSClient(conn *ssh.Client, opts DNSOptions) *DNSClient {
 	return &DNSClient{
 		sshClientConn: conn,
-		remoteDNS:     remoteDNS,
+		opts:          opts,
 	}
 }
 
 type DNSClient struct {
 	sshClientConn *ssh.Client
-	remoteDNS     string
+	opts          DNSOptions
 }
 
+// Query queries resolvers in order. next resolver is tried when failed or the answer is SERVFAIL/REFUSED.
 func (d *DNSClient) Query(domain, queryType string) (*dns.Msg, error) {
-	co := new(dns.Conn)
-	var err error
-	if co.Conn, err = d.sshClientConn.Dial("tcp4", d.remoteDNS); err != nil {
-		return nil, err
+	if len(d.opts.Resolvers) == 0 {
+		return nil, fmt.Errorf("remote DNS is not configured.")
+	}
+
+	errs := make([]string, 0, len(d.opts.Resolvers))
+	connFailed := false
+	for _, resolver := range d.opts.Resolvers {
+		dnsMsg, err := d.queryResolver(resolver, domain, queryType)
+		if err == nil && (dnsMsg.Rcode == dns.RcodeServerFailure || dnsMsg.Rcode == dns.RcodeRefused) {
+			err = fmt.Errorf("answer is %s", dns.RcodeToString[dnsMsg.Rcode])
+		}
+		if err == nil {
+			return dnsMsg, nil
+		}
+
+		errs = append(errs, fmt.Sprintf("%s: %v", resolver, err))
+		connFailed = connFailed || IsSSHConnError(err)
+	}
+
+	err := fmt.Errorf("all remote DNS failed: %s", strings.Join(errs, ", "))
+	if connFailed {
+		return nil, sshConnError(err)
+	}
+
+	return nil, err
+}
+
+// SSHConnError is failure of ssh connection to the bastion, not DNS answer.
+// only this error is recovered by reconnecting bastion.
+type SSHConnError struct {
+	Err error
+}
+
+func (e *SSHConnError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *SSHConnError) Unwrap() error {
+	return e.Err
+}
+
+// sshConnError wraps err as SSHConnError. rejected channel (ex. resolver is unreachable from the bastion)
+// means ssh connection is alive, so it is not wrapped.
+func sshConnError(err error) error {
+	var openErr *ssh.OpenChannelError
+	if errors.As(err, &openErr) {
+		return err
+	}
+
+	return &SSHConnError{Err: err}
+}
+
+// IsSSHConnError returns whether err is caused by ssh connection.
+func IsSSHConnError(err error) bool {
+	var connErr *SSHConnError
+	return errors.As(err, &connErr)
+}
+
+func (d *DNSClient) queryResolver(resolver, domain, queryType string) (*dns.Msg, error) {
+	m := newQueryMsg(domain, queryType, d.opts.udpSize())
+
+	if d.opts.Protocol == DNS_PROTOCOL_UDP {
+		dnsMsg, err := d.exchangeUDP(resolver, m)
+		if err != nil {
+			return nil, err
+		}
+
+		if !dnsMsg.Truncated {
+			return dnsMsg, nil
+		}
+		// too large for UDP, retry with TCP.
 	}
-	defer co.Close()
 
+	return d.exchangeTCP(resolver, m)
+}
+
+func newQueryMsg(domain, queryType string, udpSize uint16) *dns.Msg {
 	m := &dns.Msg{
 		MsgHdr: dns.MsgHdr{
+			Id:                dns.Id(),
 			Authoritative:     false,
 			AuthenticatedData: false,
 			CheckingDisabled:  false,
@@ -41,6 +167,10 @@ func (d *DNSClient) Query(domain, queryType string) (*dns.Msg, error) {
 
 	qType := dns.TypeA
 	switch queryType {
+	case "AAAA":
+		qType = dns.TypeAAAA
+	case "CNAME":
+		qType = dns.TypeCNAME
 	case "SRV":
 		qType = dns.TypeSRV
 	}
@@ -51,8 +181,22 @@ func (d *DNSClient) Query(domain, queryType string) (*dns.Msg, error) {
 		Qclass: uint16(dns.ClassINET),
 	}
 
-	co.SetReadDeadline(time.Now().Add(2 * time.Second))
-	co.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	// larger UDP answer (ex. many SRV records) without truncation.
+	m.SetEdns0(udpSize, false)
+
+	return m
+}
+
+func (d *DNSClient) exchangeTCP(resolver string, m *dns.Msg) (*dns.Msg, error) {
+	co := new(dns.Conn)
+	var err error
+	if co.Conn, err = d.sshClientConn.Dial("tcp", resolver); err != nil {
+		return nil, sshConnError(err)
+	}
+	defer co.Close()
+
+	co.SetReadDeadline(time.Now().Add(d.opts.timeout()))
+	co.SetWriteDeadline(time.Now().Add(d.opts.timeout()))
 
 	if err := co.WriteMsg(m); err != nil {
 		return nil, fmt.Errorf("dns write error: %v", err)
@@ -66,6 +210,205 @@ func (d *DNSClient) Query(domain, queryType string) (*dns.Msg, error) {
 	return dnsMsg, nil
 }
 
+// exchangeUDP sends raw DNS message (without TCP length prefix) to the helper, and the helper relays it as UDP datagram.
+func (d *DNSClient) exchangeUDP(resolver string, m *dns.Msg) (*dns.Msg, error) {
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("dns pack error: %v", err)
+	}
+
+	helper := d.opts.UDPHelper
+	if helper == "" {
+		helper = DEFAULT_DNS_UDP_HELPER
+	}
+
+	var stream io.ReadWriteCloser
+	if strings.HasPrefix(helper, DNS_UDP_HELPER_UNIX_PREFIX) {
+		stream, err = d.sshClientConn.Dial("unix", strings.TrimPrefix(helper, DNS_UDP_HELPER_UNIX_PREFIX))
+		if err != nil {
+			err = sshConnError(err)
+		}
+	} else {
+		var command string
+		command, err = expandDNSUDPHelper(helper, resolver)
+		if err == nil {
+			stream, err = d.startHelper(command)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to start dns udp helper: %w", err)
+	}
+	defer stream.Close()
+
+	// session does not have deadline, so close it when timed out.
+	timer := time.AfterFunc(d.opts.timeout(), func() {
+		stream.Close()
+	})
+	defer timer.Stop()
+
+	dnsMsg, err := exchangeStream(stream, packed, m.Id, d.opts.udpSize())
+	if err != nil && !timer.Stop() {
+		return nil, fmt.Errorf("dns read error: timeout after %v", d.opts.timeout())
+	}
+
+	return dnsMsg, err
+}
+
+// exchangeStream writes packed DNS message to the stream, and reads response.
+// stream has no message boundary, so it reads until a whole message is received.
+func exchangeStream(stream io.ReadWriter, packed []byte, id uint16, size uint16) (*dns.Msg, error) {
+	if _, err := stream.Write(packed); err != nil {
+		return nil, fmt.Errorf("dns write error: %v", err)
+	}
+
+	buf := make([]byte, 0, size)
+	chunk := make([]byte, size)
+	for {
+		n, err := stream.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+
+		dnsMsg := new(dns.Msg)
+		if n > 0 && dnsMsg.Unpack(buf) == nil {
+			if dnsMsg.Id != id {
+				return nil, fmt.Errorf("dns id mismatch.")
+			}
+			return dnsMsg, nil
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("dns read error: %v", err)
+		}
+	}
+}
+
+// ValidateDNSUDPHelper checks placeholders of the helper command.
+// the command must have %s or %h for the resolver, and unknown placeholder is error.
+func ValidateDNSUDPHelper(helper string) error {
+	if strings.HasPrefix(helper, DNS_UDP_HELPER_UNIX_PREFIX) {
+		return nil
+	}
+
+	_, err := expandDNSUDPHelper(helper, "127.0.0.1:53")
+	return err
+}
+
+// expandDNSUDPHelper replaces placeholders in the helper command with the resolver address.
+func expandDNSUDPHelper(helper, resolver string) (string, error) {
+	host, port, err := net.SplitHostPort(resolver)
+	if err != nil {
+		return "", fmt.Errorf("invalid resolver %s: %v", resolver, err)
+	}
+
+	var b strings.Builder
+	hasResolver := false
+	for i := 0; i < len(helper); i++ {
+		if helper[i] != '%' {
+			b.WriteByte(helper[i])
+			continue
+		}
+
+		i++
+		if i == len(helper) {
+			return "", fmt.Errorf("trailing %% in %q", helper)
+		}
+
+		switch helper[i] {
+		case '%':
+			b.WriteByte('%')
+		case 's':
+			b.WriteString(resolver)
+			hasResolver = true
+		case 'h':
+			b.WriteString(host)
+			hasResolver = true
+		case 'p':
+			b.WriteString(port)
+		default:
+			return "", fmt.Errorf("unknown placeholder %%%c in %q. use %%s, %%h, %%p or %%%%", helper[i], helper)
+		}
+	}
+
+	if !hasResolver {
+		return "", fmt.Errorf("%%s or %%h is required for resolver address in %q", helper)
+	}
+
+	return b.String(), nil
+}
+
+// startHelper runs the helper command in the bastion. stdin and stdout of the command is the stream.
+func (d *DNSClient) startHelper(command string) (io.ReadWriteCloser, error) {
+	session, err := d.sshClientConn.NewSession()
+	if err != nil {
+		return nil, sshConnError(err)
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	stderr := &bytes.Buffer{}
+	session.Stderr = stderr
+
+	err = session.Start(command)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	return &helperStream{session: session, stdin: stdin, stdout: stdout, stderr: stderr}, nil
+}
+
+type helperStream struct {
+	session *ssh.Session
+	stdin   io.WriteCloser
+	stdout  io.Reader
+	stderr  *bytes.Buffer
+}
+
+func (h *helperStream) Read(p []byte) (int, error) {
+	n, err := h.stdout.Read(p)
+	if err != nil {
+		return n, h.exitError(err)
+	}
+
+	return n, nil
+}
+
+func (h *helperStream) Write(p []byte) (int, error) {
+	n, err := h.stdin.Write(p)
+	if err != nil {
+		return n, h.exitError(err)
+	}
+
+	return n, nil
+}
+
+// exitError returns helper failure reason (ex. command not found) instead of EOF.
+func (h *helperStream) exitError(err error) error {
+	var exitErr *ssh.ExitError
+	if !errors.As(h.session.Wait(), &exitErr) {
+		return err
+	}
+
+	if h.stderr.Len() > 0 {
+		return fmt.Errorf("helper exited with status %d: %s", exitErr.ExitStatus(), strings.TrimSpace(h.stderr.String()))
+	}
+
+	return fmt.Errorf("helper exited with status %d", exitErr.ExitStatus())
+}
+
+func (h *helperStream) Close() error {
+	return h.session.Close()
+}
+
 func (d *DNSClient) QueryA(domain string) ([]*dns.A, error) {
 	dnsMsg, err := d.Query(domain, "A")
 	if err != nil {
@@ -74,13 +417,73 @@ func (d *DNSClient) QueryA(domain string) ([]*dns.A, error) {
 
 	records := make([]*dns.A, 0, len(dnsMsg.Answer))
 	for _, ans := range dnsMsg.Answer {
-		a := ans.(*dns.A)
-		records = append(records, a)
+		// answer may have other type records (ex. CNAME before A)
+		if a, ok := ans.(*dns.A); ok {
+			records = append(records, a)
+		}
+	}
+
+	return records, nil
+}
+
+func (d *DNSClient) QueryAAAA(domain string) ([]*dns.AAAA, error) {
+	dnsMsg, err := d.Query(domain, "AAAA")
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*dns.AAAA, 0, len(dnsMsg.Answer))
+	for _, ans := range dnsMsg.Answer {
+		// answer may have other type records (ex. CNAME before AAAA)
+		if aaaa, ok := ans.(*dns.AAAA); ok {
+			records = append(records, aaaa)
+		}
 	}
 
 	return records, nil
 }
 
+// QueryIP queries A and/or AAAA records by family, and returns addresses and minimum TTL.
+// IP_FAMILY_ANY returns IPv4 addresses first, and it is error only when both queries failed.
+func (d *DNSClient) QueryIP(domain, family string) ([]net.IP, uint32, error) {
+	ips := make([]net.IP, 0)
+	var ttl uint32
+	addTTL := func(t uint32) {
+		if len(ips) == 0 || t < ttl {
+			ttl = t
+		}
+	}
+
+	var errs []string
+	if family != IP_FAMILY_V6 {
+		records, err := d.QueryA(domain)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("A: %v", err))
+		}
+		for _, r := range records {
+			addTTL(r.Hdr.Ttl)
+			ips = append(ips, r.A)
+		}
+	}
+
+	if family == IP_FAMILY_V6 || family == IP_FAMILY_ANY {
+		records, err := d.QueryAAAA(domain)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("AAAA: %v", err))
+		}
+		for _, r := range records {
+			addTTL(r.Hdr.Ttl)
+			ips = append(ips, r.AAAA)
+		}
+	}
+
+	if len(ips) == 0 && len(errs) > 0 {
+		return nil, 0, fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+
+	return ips, ttl, nil
+}
+
 func (d *DNSClient) QueryCNAME(domain string) ([]*dns.CNAME, error) {
 	dnsMsg, err := d.Query(domain, "CNAME")
 	if err != nil {
@@ -89,8 +492,9 @@ func (d *DNSClient) QueryCNAME(domain string) ([]*dns.CNAME, error) {
 
 	records := make([]*dns.CNAME, 0, len(dnsMsg.Answer))
 	for _, ans := range dnsMsg.Answer {
-		a := ans.(*dns.CNAME)
-		records = append(records, a)
+		if a, ok := ans.(*dns.CNAME); ok {
+			records = append(records, a)
+		}
 	}
 
 	return records, nil
@@ -104,8 +508,9 @@ func (d *DNSClient) QuerySRV(domain string) ([]*dns.SRV, error) {
 
 	records := make([]*dns.SRV, 0, len(dnsMsg.Answer))
 	for _, ans := range dnsMsg.Answer {
-		srv := ans.(*dns.SRV)
-		records = append(records, srv)
+		if srv, ok := ans.(*dns.SRV); ok {
+			records = append(records, srv)
+		}
 	}
 
 	return records, nil
@@ -0,0 +1,149 @@
+package mogura
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestExpandDNSUDPHelper(t *testing.T) {
+	tests := []struct {
+		helper   string
+		resolver string
+		want     string
+		wantErr  bool
+	}{
+		{helper: DEFAULT_DNS_UDP_HELPER, resolver: "10.0.0.2:53", want: "socat -T2 - UDP:10.0.0.2:53"},
+		{helper: "nc -u -w2 %h %p", resolver: "10.0.0.2:53", want: "nc -u -w2 10.0.0.2 53"},
+		{helper: "nc -u -w2 %h %p", resolver: "[fd00::2]:5353", want: "nc -u -w2 fd00::2 5353"},
+		{helper: "relay --resolver=%s --pct=100%%", resolver: "10.0.0.2:53", want: "relay --resolver=10.0.0.2:53 --pct=100%"},
+		{helper: "socat - UDP:10.0.0.2:53", resolver: "10.0.0.2:53", wantErr: true},
+		{helper: "nc -u %p", resolver: "10.0.0.2:53", wantErr: true},
+		{helper: "nc -u %d", resolver: "10.0.0.2:53", wantErr: true},
+		{helper: "nc -u %h %", resolver: "10.0.0.2:53", wantErr: true},
+		{helper: "nc -u %h", resolver: "10.0.0.2", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := expandDNSUDPHelper(tt.helper, tt.resolver)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("expandDNSUDPHelper(%q, %s) = %q, want error", tt.helper, tt.resolver, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("expandDNSUDPHelper(%q, %s) error: %v", tt.helper, tt.resolver, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("expandDNSUDPHelper(%q, %s) = %q, want %q", tt.helper, tt.resolver, got, tt.want)
+		}
+	}
+}
+
+func TestValidateDNSUDPHelper(t *testing.T) {
+	for _, helper := range []string{DEFAULT_DNS_UDP_HELPER, "nc -u -w2 %h %p", "unix:/run/mogura-dns.sock"} {
+		if err := ValidateDNSUDPHelper(helper); err != nil {
+			t.Errorf("ValidateDNSUDPHelper(%q) error: %v", helper, err)
+		}
+	}
+
+	if err := ValidateDNSUDPHelper("nc -u -w2"); err == nil {
+		t.Error("ValidateDNSUDPHelper without placeholder is not error")
+	}
+}
+
+// chunkedStream returns chunks for each Read like helper stdout, and EOF after all chunks.
+type chunkedStream struct {
+	chunks  [][]byte
+	written bytes.Buffer
+}
+
+func (s *chunkedStream) Read(p []byte) (int, error) {
+	if len(s.chunks) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(p, s.chunks[0])
+	s.chunks[0] = s.chunks[0][n:]
+	if len(s.chunks[0]) == 0 {
+		s.chunks = s.chunks[1:]
+	}
+
+	return n, nil
+}
+
+func (s *chunkedStream) Write(p []byte) (int, error) {
+	return s.written.Write(p)
+}
+
+func TestExchangeStream(t *testing.T) {
+	query := new(dns.Msg)
+	query.SetQuestion("db.internal.", dns.TypeA)
+	packed, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	answer := new(dns.Msg)
+	answer.SetReply(query)
+	rr, err := dns.NewRR("db.internal. 60 IN A 10.0.0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer.Answer = append(answer.Answer, rr)
+	response, err := answer.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := answer.Copy()
+	other.Id = query.Id + 1
+	otherResponse, err := other.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		chunks  [][]byte
+		wantErr string
+	}{
+		{name: "whole message", chunks: [][]byte{response}},
+		{name: "split message", chunks: [][]byte{response[:5], response[5:20], response[20:]}},
+		{name: "id mismatch", chunks: [][]byte{otherResponse}, wantErr: "dns id mismatch"},
+		{name: "EOF before whole message", chunks: [][]byte{response[:len(response)-1]}, wantErr: "dns read error"},
+		{name: "no response", wantErr: "dns read error"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := &chunkedStream{chunks: tt.chunks}
+			got, err := exchangeStream(stream, packed, query.Id, DEFAULT_DNS_UDP_SIZE)
+
+			// query is raw DNS message without TCP length prefix.
+			if !bytes.Equal(stream.written.Bytes(), packed) {
+				t.Errorf("written %v, want %v", stream.written.Bytes(), packed)
+			}
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got error %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got.Answer) != 1 || got.Answer[0].String() != rr.String() {
+				t.Errorf("answer is %v, want %v", got.Answer, rr)
+			}
+		})
+	}
+}
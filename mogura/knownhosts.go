@@ -0,0 +1,156 @@
+package mogura
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// serialize writing to known_hosts file when multiple tunnels trust on first use at the same time.
+var knownHostsWriteMutex sync.Mutex
+
+// NewHostKeyCallback returns HostKeyCallback that verifies host key with known_hosts file.
+// it supports hashed hostname entries and @cert-authority / @revoked lines.
+// if trustOnFirstUse is true, then unknown host key is added to known_hosts file and accepted.
+// host key mismatch is always error.
+func NewHostKeyCallback(knownHostsPath string, trustOnFirstUse bool) (ssh.HostKeyCallback, error) {
+	if knownHostsPath == "" {
+		return nil, fmt.Errorf("known_hosts path is required.")
+	}
+
+	_, err := os.Stat(knownHostsPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("can not read known_hosts %s: %v", knownHostsPath, err)
+		}
+
+		if !trustOnFirstUse {
+			return nil, fmt.Errorf("known_hosts %s does not exist. please add bastion host key with ssh-keyscan or connect once with ssh, or set host_key_check: tofu", knownHostsPath)
+		}
+
+		// create empty known_hosts for first use.
+		err = createKnownHostsFile(knownHostsPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	callback, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		return nil, fmt.Errorf("can not load known_hosts %s: %v", knownHostsPath, err)
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			// revoked key or broken remote address.
+			return fmt.Errorf("host key verification failed for %s: %v", hostname, err)
+		}
+
+		if len(keyErr.Want) > 0 {
+			want := keyErr.Want[0]
+			return fmt.Errorf("host key mismatch for %s: got %s %s, but %s:%d has %s %s. it is possible that someone is doing something nasty (man-in-the-middle attack). if host key was changed intentionally, then remove old key from known_hosts",
+				hostname, key.Type(), ssh.FingerprintSHA256(key), want.Filename, want.Line, want.Key.Type(), ssh.FingerprintSHA256(want.Key))
+		}
+
+		// unknown host
+		if !trustOnFirstUse {
+			return fmt.Errorf("host key for %s is unknown (%s %s). please add it to %s or set host_key_check: tofu", hostname, key.Type(), ssh.FingerprintSHA256(key), knownHostsPath)
+		}
+
+		err = appendKnownHost(knownHostsPath, hostname, remote, key)
+		if err != nil {
+			return fmt.Errorf("failed trust on first use for %s: %v", hostname, err)
+		}
+		Logger().Warn("permanently added host key to known_hosts", LOG_KEY_REMOTE, hostname, "key_type", key.Type(), "fingerprint", ssh.FingerprintSHA256(key), "known_hosts", knownHostsPath)
+
+		return nil
+	}, nil
+}
+
+// KnownHostKeyAlgorithms returns host key algorithms that are already known for the host.
+// ssh server may offer other key type that is not in known_hosts, then it is detected as mismatch.
+// so prefer to known key algorithms like OpenSSH does. returns nil if the host is unknown.
+func KnownHostKeyAlgorithms(knownHostsPath, hostport string) []string {
+	callback, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		return nil
+	}
+
+	// check with dummy key, then KeyError has all known keys for the host.
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil
+	}
+	dummy, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil
+	}
+
+	err = callback(hostport, &net.TCPAddr{IP: net.IPv4zero}, dummy)
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		return nil
+	}
+
+	algos := make([]string, 0, len(keyErr.Want))
+	for _, k := range keyErr.Want {
+		switch k.Key.Type() {
+		case ssh.KeyAlgoRSA:
+			algos = append(algos, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			algos = append(algos, k.Key.Type())
+		}
+	}
+
+	return algos
+}
+
+func createKnownHostsFile(path string) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return fmt.Errorf("can not create known_hosts dir: %v", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("can not create known_hosts %s: %v", path, err)
+	}
+
+	return f.Close()
+}
+
+func appendKnownHost(path, hostname string, remote net.Addr, key ssh.PublicKey) error {
+	knownHostsWriteMutex.Lock()
+	defer knownHostsWriteMutex.Unlock()
+
+	addresses := []string{hostname}
+	if tcpAddr, ok := remote.(*net.TCPAddr); ok {
+		host, _, err := net.SplitHostPort(hostname)
+		if err == nil && host != tcpAddr.IP.String() {
+			addresses = append(addresses, tcpAddr.String())
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(knownhosts.Line(addresses, key) + "\n")
+	return err
+}
@@ -0,0 +1,37 @@
+package mogura
+
+import (
+	"log/slog"
+	"sync/atomic"
+)
+
+// log field keys. use same keys everywhere, so logs can be filtered by them.
+const (
+	LOG_KEY_TUNNEL  = "tunnel"
+	LOG_KEY_BASTION = "bastion"
+	LOG_KEY_TARGET  = "target"
+	LOG_KEY_REMOTE  = "remote"
+	LOG_KEY_ERROR   = "error"
+)
+
+var logger atomic.Pointer[slog.Logger]
+
+// SetLogger replaces logger of mogura package. default is slog.Default().
+func SetLogger(l *slog.Logger) {
+	logger.Store(l)
+}
+
+// Logger returns logger of mogura package.
+func Logger() *slog.Logger {
+	l := logger.Load()
+	if l == nil {
+		return slog.Default()
+	}
+
+	return l
+}
+
+// logger returns logger with tunnel fields.
+func (m *Mogura) logger() *slog.Logger {
+	return Logger().With(LOG_KEY_TUNNEL, m.Config.Tunnel, LOG_KEY_BASTION, m.bastion.Config.Name)
+}
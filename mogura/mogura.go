@@ -2,14 +2,15 @@ package mogura
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"golang.org/x/crypto/ssh"
 	"io"
-	"log"
 	"net"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,53 +18,122 @@ const (
 	ENV_MOGURA_PASSPHRASE = "MOGURA_PASSPHRASE"
 
 	WarningThresholdForRetrying = 3
+
+	TUNNEL_TYPE_FORWARD = "forward"
+	TUNNEL_TYPE_SOCKS5  = "socks5"
+
+	DEFAULT_RESOLVE_MIN_INTERVAL = 5 * time.Second
+	DEFAULT_RESOLVE_MAX_INTERVAL = 1 * time.Minute
+
+	// retry interval of temporary accept error (ex. too many open files), same as net/http.Server.
+	ACCEPT_RETRY_MIN_DELAY = 5 * time.Millisecond
+	ACCEPT_RETRY_MAX_DELAY = 1 * time.Second
 )
 
 type MoguraConfig struct {
-	Name             string
-	BastionHostPort  string
-	Username         string
-	KeyPath          string
-	RemoteDNS        string
+	// display name
+	Name string
+	// tunnel name for log
+	Tunnel           string
+	RemoteDNS        DNSOptions
 	LocalBindPort    string
+	LocalBindSocket  string // unix domain socket path, used instead of LocalBindPort
 	ForwardingTarget Target
+
+	// dial SRV targets in RFC 2782 order per connection instead of pinning one target.
+	LoadBalance bool
+
+	Forwarding ForwardingOptions
+	Resolve    ResolveOptions
+
+	// TUNNEL_TYPE_FORWARD(default) or TUNNEL_TYPE_SOCKS5
+	TunnelType string
+	// DIRECTION_LOCAL(default) or DIRECTION_REMOTE.
+	// remote forwards connections on RemoteBindAddress in the bastion to local ForwardingTarget.
+	Direction         string
+	RemoteBindAddress string
+	// used when TunnelType is TUNNEL_TYPE_SOCKS5
+	Socks5 Socks5Config
 }
 
 // error is ssh connection and local listener error.
 // error channel transfer flow error
-func GoMogura(c MoguraConfig) (*Mogura, error) {
+// bastion must be acquired from BastionPool, and it is released when Mogura closed or GoMogura failed.
+func GoMogura(c MoguraConfig, bastion *Bastion) (*Mogura, error) {
 	m := &Mogura{
-		Config: c,
+		Config:  c,
+		bastion: bastion,
 	}
 
 	m.localDoneChan = make(chan struct{})
 	m.remoteDoneChan = make(chan struct{})
-	err := m.ConnectSSH()
-	if err != nil {
-		return nil, err
+
+	// canceled when tunnel closed, then forwarding connections are closed.
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+
+	m.errChan = make(chan error)
+	m.errOutChan = make(chan error)
+	go func() {
+		// record last error for stats, and pass to ErrChan reader.
+		// errors after closed are dropped, because reader may be gone.
+		for e := range m.errChan {
+			m.counters.recordError(e)
+			select {
+			case m.errOutChan <- e:
+			case <-m.ctx.Done():
+			}
+		}
+		close(m.errOutChan)
+	}()
+
+	if c.Direction == DIRECTION_REMOTE {
+		// target is in local, so no remote resolve.
+		m.setDetectedRemote(c.ForwardingTarget.HostPort())
+		client, err := m.listenRemote()
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+
+		m.goSending(func() {
+			m.remoteAcceptLoop(m.ctx, client)
+		})
+		return m, nil
 	}
 
-	err = m.Listen()
+	err := m.Listen()
 	if err != nil {
+		m.Close()
 		return nil, err
 	}
 
+	if c.TunnelType == TUNNEL_TYPE_SOCKS5 {
+		// destination is decided by each socks5 request, so no resolve and dial test.
+		listener := m.localListener
+		m.goSending(func() {
+			m.socks5AcceptLoop(m.ctx, listener)
+		})
+		return m, nil
+	}
+
 	err = m.ResolveRemote()
 	if err != nil {
+		m.Close()
 		return nil, err
 	}
 
-	m.errChan = make(chan error)
-	resolveErrChan := m.GoResolveCycle(10)
-	go func() {
-		// chain error channel
-		for e := range resolveErrChan {
-			m.errChan <- e
-		}
-	}()
+	if c.ForwardingTarget.NeedsResolve() {
+		resolveErrChan := m.GoResolveCycle()
+		m.goSending(func() {
+			// chain error channel
+			for e := range resolveErrChan {
+				m.errChan <- e
+			}
+		})
+	}
 
 	// test ssh connection fowarding
-	testSshConn, err := m.sshClientConn.Dial("tcp", m.detectedRemote)
+	testSshConn, err := m.dialTarget()
 	if err != nil {
 		// close local listener and remote connection. client can request to listener and wait forever if this close forgot.
 		m.Close()
@@ -75,27 +145,23 @@ func GoMogura(c MoguraConfig) (*Mogura, error) {
 	}
 	testSshConn.Close()
 
-	ctx := context.TODO()
-	// go accept loop
-	go func(ctx context.Context) {
+	ctx := m.ctx
+	listener := m.localListener
+	// go accept loop. listener is copied because Close sets m.localListener to nil.
+	m.goSending(func() {
 		for {
 			// Setup localConn (type net.Conn)
 			// closed check logic refs:
 			// https://stackoverflow.com/questions/13417095/how-do-i-stop-a-listening-server-in-go
-			localConn, err := m.localListener.Accept()
-			if err != nil {
-				select {
-				case <-m.localDoneChan:
-					return
-				default:
-					// maybe reconnection.
-					m.errChan <- fmt.Errorf("listen.Accept failed: %v", err)
-					continue
-				}
+			localConn := m.acceptLocal(listener)
+			if localConn == nil {
+				return
 			}
 
+			m.counters.connectionAccepted()
+
 			// Setup sshConn (type net.Conn)
-			sshConn, err := m.sshClientConn.Dial("tcp", m.detectedRemote)
+			sshConn, err := m.dialTarget()
 			if err != nil {
 				select {
 				case <-m.remoteDoneChan:
@@ -112,26 +178,20 @@ func GoMogura(c MoguraConfig) (*Mogura, error) {
 						// close local listener and remote connection. client can request to listener and wait forever if this close forgot.
 						m.Close()
 						return
-					} else {
-						m.errChan <- fmt.Errorf("remote dial failed: %v", err)
-					}
-
-					// not remote done? SSH connection is dead?
-					sshErr := m.ConnectSSH()
-					if sshErr != nil {
-						m.errChan <- fmt.Errorf("failed ssh reconnect: %v", sshErr)
 					}
 
+					m.errChan <- fmt.Errorf("remote dial failed: %v", err)
 					localConn.Close()
 					continue
 				}
 			}
 
 			// go forwarding
-			timeout := m.Config.ForwardingTarget.ForwardingTimeout
-			go forward(ctx, localConn, sshConn, timeout, m.errChan)
+			m.goSending(func() {
+				forward(ctx, localConn, sshConn, m.Config.Forwarding, &m.counters, m.errChan)
+			})
 		}
-	}(ctx)
+	})
 
 	return m, nil
 }
@@ -139,50 +199,195 @@ func GoMogura(c MoguraConfig) (*Mogura, error) {
 type Mogura struct {
 	Config MoguraConfig
 
-	errChan chan error
+	errChan    chan error
+	errOutChan chan error
 
 	// internal
-	sshClientConn  *ssh.Client
-	localListener  net.Listener
-	detectedRemote string
+	bastion             *Bastion
+	localListener       net.Listener
+	detectedRemote      string
+	endpoints           []Endpoint
+	detectedRemoteMutex sync.RWMutex
+
+	counters tunnelCounters
 
-	sshMutex sync.Mutex
+	// listener in the bastion for remote direction
+	remoteListener      net.Listener
+	remoteListenerMutex sync.Mutex
 
-	localDoneChan  chan struct{}
-	remoteDoneChan chan struct{}
+	localDoneChan   chan struct{}
+	localCloseOnce  sync.Once
+	remoteDoneChan  chan struct{}
+	remoteCloseOnce sync.Once
+
+	// goroutines that send to errChan. errChan is closed after all of them finished.
+	senders      sync.WaitGroup
+	errCloseOnce sync.Once
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Done is closed when the tunnel is closed. the tunnel closes itself when it can not continue
+// (ex. forwarding is prohibited by the bastion).
+func (m *Mogura) Done() <-chan struct{} {
+	return m.ctx.Done()
 }
 
+// ErrChan returns transfer errors. it is closed after the tunnel closed.
 func (m *Mogura) ErrChan() <-chan error {
-	return m.errChan
+	return m.errOutChan
 }
 
-func (m *Mogura) ConnectSSH() error {
-	m.sshMutex.Lock()
-	defer m.sshMutex.Unlock()
+// goSending runs f in goroutine that may send to errChan.
+// it must be called from GoMogura or other goSending goroutine, so senders is not zero while adding.
+func (m *Mogura) goSending(f func()) {
+	m.senders.Add(1)
+	go func() {
+		defer m.senders.Done()
+		f()
+	}()
+}
 
-	passphrase := os.Getenv(ENV_MOGURA_PASSPHRASE)
-	clientConfig, err := GenSSHClientConfig(m.Config.BastionHostPort, m.Config.Username, m.Config.KeyPath, passphrase)
-	if err != nil {
-		return fmt.Errorf("ssh config error: %v", err)
+// DetectedRemote returns resolved forwarding target host:port.
+func (m *Mogura) DetectedRemote() string {
+	m.detectedRemoteMutex.RLock()
+	defer m.detectedRemoteMutex.RUnlock()
+
+	return m.detectedRemote
+}
+
+func (m *Mogura) setDetectedRemote(remote string) {
+	m.detectedRemoteMutex.Lock()
+	defer m.detectedRemoteMutex.Unlock()
+
+	m.detectedRemote = remote
+}
+
+// Endpoints returns all resolved forwarding targets.
+func (m *Mogura) Endpoints() []Endpoint {
+	m.detectedRemoteMutex.RLock()
+	defer m.detectedRemoteMutex.RUnlock()
+
+	return m.endpoints
+}
+
+func (m *Mogura) setEndpoints(endpoints []Endpoint) {
+	m.detectedRemoteMutex.Lock()
+	defer m.detectedRemoteMutex.Unlock()
+
+	m.endpoints = endpoints
+}
+
+// dialOrder returns forwarding target addresses in trying order.
+// pinned target is first, and other targets are for failover.
+// when LoadBalance, then order is decided per connection by RFC 2782.
+func (m *Mogura) dialOrder() []string {
+	endpoints := m.Endpoints()
+	pinned := m.DetectedRemote()
+	if m.Config.LoadBalance {
+		pinned = ""
 	}
 
-	// Setup sshClientConn (type *ssh.ClientConn)
-	sshClientConn, err := ssh.Dial("tcp", m.Config.BastionHostPort, clientConfig)
-	if err != nil {
-		return fmt.Errorf("ssh.Dial failed: %v", err)
+	addrs := make([]string, 0, len(endpoints)+1)
+	if pinned != "" {
+		addrs = append(addrs, pinned)
 	}
 
-	// close current connection before change new connection.
-	if m.sshClientConn != nil {
-		m.sshClientConn.Close()
+	for _, e := range OrderEndpoints(endpoints) {
+		if e.HostPort() != pinned {
+			addrs = append(addrs, e.HostPort())
+		}
 	}
 
-	m.sshClientConn = sshClientConn
+	return addrs
+}
 
-	return nil
+// dialTarget dials forwarding target. when the target refused connection, then tries next target.
+func (m *Mogura) dialTarget() (net.Conn, error) {
+	addrs := m.dialOrder()
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no resolved target.")
+	}
+
+	var err error
+	for i, addr := range addrs {
+		var conn net.Conn
+		conn, err = m.dialRemoteWithReconnect(addr)
+		if err == nil {
+			return conn, nil
+		}
+
+		// only the target is unreachable. other errors (ex. prohibited or ssh error) are same for all targets.
+		var openErr *ssh.OpenChannelError
+		if !errors.As(err, &openErr) || openErr.Reason != ssh.ConnectionFailed {
+			return nil, err
+		}
+
+		if i+1 < len(addrs) {
+			m.logger().Warn("target dial failed, trying next target", LOG_KEY_REMOTE, addr, "next", addrs[i+1], LOG_KEY_ERROR, err)
+		}
+	}
+
+	return nil, err
+}
+
+// Bastion returns shared bastion connection of this tunnel.
+func (m *Mogura) Bastion() *Bastion {
+	return m.bastion
+}
+
+// dialRemoteWithReconnect dials addr, and when ssh connection seems dead then reconnects bastion and retries once.
+// remote rejection (ex. connection refused by addr) is returned as is, because reconnecting shared
+// bastion connection does not fix it and breaks other tunnels connections.
+func (m *Mogura) dialRemoteWithReconnect(addr string) (net.Conn, error) {
+	conn, client, err := m.dialRemote(addr)
+	if err == nil {
+		return conn, nil
+	}
+
+	var openErr *ssh.OpenChannelError
+	if errors.As(err, &openErr) || client == nil {
+		m.counters.dialFailed()
+		return nil, err
+	}
+
+	sshErr := m.bastion.Reconnect(client)
+	if sshErr != nil {
+		m.counters.dialFailed()
+		return nil, fmt.Errorf("%v, and failed ssh reconnect: %v", err, sshErr)
+	}
+
+	conn, _, err = m.dialRemote(addr)
+	if err != nil {
+		m.counters.dialFailed()
+		return nil, fmt.Errorf("failed after ssh reconnect: %v", err)
+	}
+
+	return conn, nil
+}
+
+// ConnectSSH reconnects bastion ssh connection. all tunnels on the bastion are switched to new connection.
+func (m *Mogura) ConnectSSH() error {
+	return m.bastion.Reconnect(nil)
+}
+
+// dialRemote dials addr via current bastion connection. returned client is used for reconnection when dial failed.
+func (m *Mogura) dialRemote(addr string) (net.Conn, *ssh.Client, error) {
+	client := m.bastion.Client()
+	if client == nil {
+		return nil, nil, fmt.Errorf("bastion %s connection is closed.", m.bastion.Config.Name)
+	}
+
+	conn, err := client.Dial(m.Config.ForwardingTarget.Network(), addr)
+	return conn, client, err
 }
 
 func (m *Mogura) Listen() error {
+	if m.Config.LocalBindSocket != "" {
+		return m.listenSocket()
+	}
+
 	// Setup localListener (type net.Listener)
 	var err error
 	m.localListener, err = net.Listen("tcp", m.Config.LocalBindPort)
@@ -193,26 +398,121 @@ func (m *Mogura) Listen() error {
 	return nil
 }
 
-func (m *Mogura) GoResolveCycle(interval int64) <-chan error {
+// listenSocket listens unix domain socket. socket file is removed when listener closed.
+func (m *Mogura) listenSocket() error {
+	path := m.Config.LocalBindSocket
+	if fi, err := os.Lstat(path); err == nil {
+		// do not remove other file by wrong setting.
+		if fi.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("local socket %s already exists and it is not socket.", path)
+		}
+
+		// left by crashed mogura, or used by other process.
+		conn, err := net.DialTimeout("unix", path, time.Second)
+		if err == nil {
+			conn.Close()
+			return fmt.Errorf("local socket %s is in use.", path)
+		}
+
+		err = os.Remove(path)
+		if err != nil {
+			return fmt.Errorf("can not remove stale local socket: %v", err)
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("local socket binding failed: %v", err)
+	}
+
+	// only the user can connect the tunnel.
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		l.Close()
+		return fmt.Errorf("can not change local socket permission: %v", err)
+	}
+
+	m.localListener = l
+	return nil
+}
+
+// ResolveOptions is re-resolution schedule of forwarding target.
+type ResolveOptions struct {
+	// fixed interval. 0 is TTL of DNS records.
+	Interval time.Duration
+	// TTL is clamped in this range. 0 is default.
+	MinInterval time.Duration
+	MaxInterval time.Duration
+}
+
+// NextInterval returns waiting time before next resolve.
+// ttl 0 (unknown or resolve failed) is min interval for quick recovery.
+func (o ResolveOptions) NextInterval(ttl time.Duration) time.Duration {
+	if o.Interval > 0 {
+		return o.Interval
+	}
+
+	min := o.MinInterval
+	if min <= 0 {
+		min = DEFAULT_RESOLVE_MIN_INTERVAL
+	}
+	max := o.MaxInterval
+	if max <= 0 {
+		max = DEFAULT_RESOLVE_MAX_INTERVAL
+	}
+
+	if ttl < min {
+		return min
+	}
+	if ttl > max {
+		return max
+	}
+	return ttl
+}
+
+// GoResolveCycle resolves target again after the TTL of resolved records.
+func (m *Mogura) GoResolveCycle() <-chan error {
 	errChan := make(chan error)
-	tick := time.Tick(time.Duration(interval) * time.Second)
 	go func() {
+		defer close(errChan)
 		retryCount := 0
-		for _ = range tick {
+		ttl := m.Config.ForwardingTarget.TTL()
+		for {
+			interval := m.Config.Resolve.NextInterval(ttl)
+			m.logger().Debug("next resolve", LOG_KEY_TARGET, m.Config.ForwardingTarget.Target, "ttl", ttl, "interval", interval)
+			timer := time.NewTimer(interval)
+			select {
+			case <-m.remoteDoneChan:
+				// tunnel closed. do not touch shared bastion connection anymore.
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			client := m.bastion.Client()
 			err := m.ResolveRemote()
 			if err != nil {
+				ttl = 0
 				retryCount++
 				errChan <- err
 				if retryCount > WarningThresholdForRetrying {
 					errChan <- fmt.Errorf("resolve remote retry failed over %d times. it maybe will not recover it. stop mogura and check configuration", WarningThresholdForRetrying)
 				}
-				sshErr := m.ConnectSSH()
+
+				// reconnecting closes all forwarding connections on the bastion,
+				// so DNS answer error (ex. NXDOMAIN, empty answer) does not reconnect.
+				if !IsSSHConnError(err) {
+					continue
+				}
+
+				sshErr := m.bastion.Reconnect(client)
 				if sshErr != nil {
 					errChan <- fmt.Errorf("remote resolver failed and then ssh reconnect but failed: %v", sshErr)
 				} else {
 					// reconnected but can not notification way...
 				}
 			} else {
+				ttl = m.Config.ForwardingTarget.TTL()
 				retryCount = 0
 			}
 		}
@@ -222,59 +522,134 @@ func (m *Mogura) GoResolveCycle(interval int64) <-chan error {
 }
 
 func (m *Mogura) ResolveRemote() error {
-	err := m.Config.ForwardingTarget.Resolve(m.sshClientConn, m.Config.RemoteDNS)
+	client := m.bastion.Client()
+	if client == nil {
+		m.counters.resolveFailed()
+		return fmt.Errorf("bastion %s connection is closed.", m.bastion.Config.Name)
+	}
+
+	err := m.Config.ForwardingTarget.Resolve(client, m.Config.RemoteDNS, m.logger())
 	if err != nil {
+		m.counters.resolveFailed()
 		return err
 	}
 
+	m.setEndpoints(m.Config.ForwardingTarget.Endpoints())
 	detect := m.Config.ForwardingTarget.ResolvedTargetAndPort()
-	if detect != "" && detect != m.detectedRemote {
-		// TODO logging
-		log.Printf("target changed: %s -> %s", m.detectedRemote, detect)
-		m.detectedRemote = detect
+	current := m.DetectedRemote()
+	if detect != "" && detect != current {
+		m.setDetectedRemote(detect)
+
+		// first resolve is not change.
+		if current == "" {
+			m.logger().Info("target resolved", LOG_KEY_TARGET, m.Config.ForwardingTarget.Target, LOG_KEY_REMOTE, detect)
+		} else {
+			m.logger().Info("target changed", LOG_KEY_TARGET, m.Config.ForwardingTarget.Target, "from", current, LOG_KEY_REMOTE, detect)
+			m.counters.targetChanged()
+		}
 	}
 
 	return nil
 }
 
+// acceptLocal accepts local connection. temporary errors are retried with backoff like net/http.Server,
+// so established connections are kept. returns nil when the tunnel is closed,
+// or the listener is broken (then closes the tunnel and manager restarts it).
+func (m *Mogura) acceptLocal(listener net.Listener) net.Conn {
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err == nil {
+			return conn
+		}
+
+		select {
+		case <-m.localDoneChan:
+			return nil
+		default:
+		}
+
+		var temporary bool
+		delay, temporary = acceptRetryDelay(err, delay)
+		if !temporary {
+			m.errChan <- fmt.Errorf("listen.Accept failed: %v", err)
+			m.Close()
+			return nil
+		}
+
+		m.errChan <- fmt.Errorf("listen.Accept failed, retry after %v: %v", delay, err)
+		select {
+		case <-time.After(delay):
+		case <-m.localDoneChan:
+			return nil
+		}
+	}
+}
+
+// acceptRetryDelay returns next delay for temporary accept error, it doubles up to ACCEPT_RETRY_MAX_DELAY.
+// returns false when the error is permanent (ex. listener is closed).
+func acceptRetryDelay(err error, last time.Duration) (time.Duration, bool) {
+	var ne net.Error
+	if errors.Is(err, net.ErrClosed) || !errors.As(err, &ne) {
+		return 0, false
+	}
+
+	// Temporary is deprecated, but net/http.Server also uses it for EMFILE, ECONNABORTED, etc.
+	if !ne.Temporary() {
+		return 0, false
+	}
+
+	if last == 0 {
+		return ACCEPT_RETRY_MIN_DELAY, true
+	}
+
+	return min(last*2, ACCEPT_RETRY_MAX_DELAY), true
+}
+
+// CloseLocalConn closes local listener. it can be called from accept loop and manager at the same time.
 func (m *Mogura) CloseLocalConn() error {
 	var lErr error
-	if m.localListener != nil {
-		if m.localDoneChan != nil {
-			close(m.localDoneChan)
+	m.localCloseOnce.Do(func() {
+		close(m.localDoneChan)
+		if m.localListener != nil {
+			lErr = m.localListener.Close()
+			m.localListener = nil
 		}
-		lErr = m.localListener.Close()
-	}
+	})
 
 	if lErr != nil {
 		return fmt.Errorf("failed close local listener: %v", lErr)
 	}
 
-	m.localListener = nil
 	return nil
 }
 
+// CloseRemoteConn releases shared bastion connection. ssh connection is closed when no other tunnel uses it.
 func (m *Mogura) CloseRemoteConn() error {
 	var rErr error
-	if m.sshClientConn != nil {
-		if m.remoteDoneChan != nil {
-			close(m.remoteDoneChan)
-		}
-		rErr = m.sshClientConn.Close()
-	}
+	m.remoteCloseOnce.Do(func() {
+		close(m.remoteDoneChan)
+		m.closeRemoteListener()
+		rErr = m.bastion.Release()
+	})
 
-	if rErr != nil {
-		return fmt.Errorf("failed close ssh connection: %v", rErr)
-	}
-
-	m.sshClientConn = nil
-	return nil
+	return rErr
 }
 
+// Close closes listener and forwarding connections of this tunnel.
 func (m *Mogura) Close() error {
+	m.cancel()
 	lErr := m.CloseLocalConn()
 	rErr := m.CloseRemoteConn()
 
+	// Close may be called in the sender (accept loop), so wait senders in background.
+	m.errCloseOnce.Do(func() {
+		go func() {
+			m.senders.Wait()
+			close(m.errChan)
+		}()
+	})
+
 	if lErr != nil && rErr != nil {
 		return fmt.Errorf("%v and %v", lErr, rErr)
 	}
@@ -290,54 +665,145 @@ func (m *Mogura) Close() error {
 	return nil
 }
 
-func forward(ctx context.Context, localConn, sshConn net.Conn, timeout time.Duration, errChan chan<- error) {
+// ForwardingOptions are connection lifetime limits. zero is no limit.
+type ForwardingOptions struct {
+	// close connection when no traffic in both directions for this duration.
+	IdleTimeout time.Duration
+	// close connection after this duration even if it is active.
+	MaxLifetime time.Duration
+}
+
+// forward copies data in both directions until both directions finished.
+// when one side got EOF, then it is propagated to the other side with CloseWrite (half-close),
+// and waits for the other direction. connections are closed when forwarding finished,
+// an error happened, idle timeout or max lifetime elapsed.
+func forward(ctx context.Context, localConn, sshConn net.Conn, opts ForwardingOptions, counters *tunnelCounters, errChan chan<- error) {
+	counters.connectionOpened()
+	defer counters.connectionClosed()
+
+	ctx, cancelFunc := context.WithCancel(ctx)
+	defer cancelFunc()
+	if opts.MaxLifetime > 0 {
+		ctx, cancelFunc = context.WithTimeout(ctx, opts.MaxLifetime)
+		defer cancelFunc()
+	}
+
+	activity := &activityTracker{}
+	activity.touch()
+
+	// closed by mogura (idle timeout, lifetime), then transfer errors are expected.
+	var closedByLimit int32
+	closeBoth := func() {
+		localConn.Close()
+		sshConn.Close()
+	}
+
 	wg := &sync.WaitGroup{}
-	ctx, cancelFunc := context.WithTimeout(ctx, timeout)
+	copyHalf := func(dst, src net.Conn, direction string, transferred *int64) {
+		defer wg.Done()
+		_, err := io.Copy(&activityWriter{w: dst, activity: activity, transferred: transferred}, src)
+		if err != nil {
+			if atomic.LoadInt32(&closedByLimit) == 0 {
+				errChan <- fmt.Errorf("%s transfer failed: %v", direction, err)
+			}
+			// unblock the other direction.
+			closeBoth()
+			return
+		}
+
+		// got EOF, propagate it and wait the other direction.
+		if cw, ok := dst.(closeWriter); ok {
+			cw.CloseWrite()
+		} else {
+			closeBoth()
+		}
+	}
 
 	// Copy localConn.Reader to sshConn.Writer
 	wg.Add(1)
-	go func(wg *sync.WaitGroup) {
-		_, err := io.Copy(sshConn, localConn)
-		if err != nil {
-			errChan <- fmt.Errorf("local -> remote transfer failed: %v", err)
-		}
-		wg.Done()
-	}(wg)
+	go copyHalf(sshConn, localConn, "local -> remote", &counters.bytesSent)
 
 	// Copy sshConn.Reader to localConn.Writer
 	wg.Add(1)
-	go func(wg *sync.WaitGroup) {
-		_, err := io.Copy(localConn, sshConn)
-		if err != nil {
-			errChan <- fmt.Errorf("remote -> local transfer failed: %v", err)
-		}
-		wg.Done()
-	}(wg)
+	go copyHalf(localConn, sshConn, "remote -> local", &counters.bytesReceived)
 
 	done := make(chan struct{})
 	go func() {
 		wg.Wait()
-		cancelFunc()
 		close(done)
 	}()
 
+	var idleC <-chan time.Time
+	if opts.IdleTimeout > 0 {
+		idleTimer := time.NewTimer(opts.IdleTimeout)
+		defer idleTimer.Stop()
+		idleC = idleTimer.C
+
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				case <-ctx.Done():
+					return
+				case <-idleC:
+				}
+
+				idle := activity.idle()
+				if idle >= opts.IdleTimeout {
+					atomic.StoreInt32(&closedByLimit, 1)
+					closeBoth()
+					return
+				}
+				idleTimer.Reset(opts.IdleTimeout - idle)
+			}
+		}()
+	}
+
 	// waiting for forwarding... and close connections.
 	select {
-	// forwarding IO error
+	// both directions finished, or closed by error or idle timeout
 	case <-done:
-		// currently it can not know finished forwarding. so it is process here when only happened errors in forwarding.
-		errChan <- fmt.Errorf("got forwarding errors before timeout.")
-	// timeout
+	// max lifetime
 	case <-ctx.Done():
-		// basically proceed here with timeout, because currently it can not know that finished forwarding IO.
+		atomic.StoreInt32(&closedByLimit, 1)
+		closeBoth()
+		<-done
 	}
 
-	err := localConn.Close()
-	if err != nil {
-		errChan <- fmt.Errorf("forwarding end however failed close local conn: %v", err)
-	}
-	err = sshConn.Close()
-	if err != nil {
-		errChan <- fmt.Errorf("forwarding end, however failed close ssh conn: %v", err)
+	closeBoth()
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// activityTracker records last transfer time for idle timeout.
+type activityTracker struct {
+	last int64
+}
+
+func (a *activityTracker) touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+func (a *activityTracker) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&a.last)))
+}
+
+// activityWriter records activity and counts transferred bytes.
+type activityWriter struct {
+	w           io.Writer
+	activity    *activityTracker
+	transferred *int64
+}
+
+func (w *activityWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if n > 0 {
+		w.activity.touch()
+		atomic.AddInt64(w.transferred, int64(n))
 	}
+
+	return n, err
 }
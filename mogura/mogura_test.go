@@ -0,0 +1,283 @@
+package mogura
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "accept: too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// errorListener returns errors from Accept before returning conn.
+type errorListener struct {
+	net.Listener
+	errs []error
+}
+
+func (l *errorListener) Accept() (net.Conn, error) {
+	if len(l.errs) > 0 {
+		err := l.errs[0]
+		l.errs = l.errs[1:]
+		return nil, err
+	}
+
+	return l.Listener.Accept()
+}
+
+func TestAcceptRetryDelay(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		last          time.Duration
+		want          time.Duration
+		wantTemporary bool
+	}{
+		{name: "first temporary", err: temporaryError{}, last: 0, want: ACCEPT_RETRY_MIN_DELAY, wantTemporary: true},
+		{name: "doubles", err: temporaryError{}, last: 40 * time.Millisecond, want: 80 * time.Millisecond, wantTemporary: true},
+		{name: "capped", err: temporaryError{}, last: 800 * time.Millisecond, want: ACCEPT_RETRY_MAX_DELAY, wantTemporary: true},
+		{name: "closed listener", err: fmt.Errorf("accept: %w", net.ErrClosed), wantTemporary: false},
+		{name: "not net.Error", err: errors.New("broken"), wantTemporary: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, temporary := acceptRetryDelay(tt.err, tt.last)
+			if temporary != tt.wantTemporary {
+				t.Fatalf("temporary is %v, want %v", temporary, tt.wantTemporary)
+			}
+			if temporary && got != tt.want {
+				t.Errorf("delay is %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAcceptLocalRetriesTemporaryError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	m := &Mogura{
+		errChan:       make(chan error, 10),
+		localDoneChan: make(chan struct{}),
+	}
+	listener := &errorListener{Listener: l, errs: []error{temporaryError{}, temporaryError{}}}
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	conn := m.acceptLocal(listener)
+	if conn == nil {
+		t.Fatal("acceptLocal returned nil, want accepted connection after temporary errors")
+	}
+	conn.Close()
+
+	if len(m.errChan) != 2 {
+		t.Errorf("got %d errors, want 2", len(m.errChan))
+	}
+
+	select {
+	case <-m.localDoneChan:
+		t.Error("tunnel was closed by temporary error")
+	default:
+	}
+}
+
+// tcpPair returns connected loopback TCP connections. TCP supports half-close unlike net.Pipe.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- c
+	}()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, ok := <-accepted
+	if !ok {
+		t.Fatal("accept failed")
+	}
+
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	return client, server
+}
+
+// startForward runs forward between app and remote. it returns channel that is closed when forward returned.
+func startForward(t *testing.T, opts ForwardingOptions) (app, remote net.Conn, counters *tunnelCounters, errChan chan error, done chan struct{}) {
+	t.Helper()
+
+	app, localConn := tcpPair(t)
+	sshConn, remote := tcpPair(t)
+	counters = &tunnelCounters{}
+	errChan = make(chan error, 10)
+	done = make(chan struct{})
+	go func() {
+		forward(context.Background(), localConn, sshConn, opts, counters, errChan)
+		close(done)
+	}()
+
+	return app, remote, counters, errChan, done
+}
+
+func waitForward(t *testing.T, done <-chan struct{}, timeout time.Duration) time.Duration {
+	t.Helper()
+
+	start := time.Now()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatalf("forward did not finish in %v", timeout)
+	}
+
+	return time.Since(start)
+}
+
+func TestForwardHalfClose(t *testing.T) {
+	app, remote, counters, errChan, done := startForward(t, ForwardingOptions{})
+
+	_, err := app.Write([]byte("request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// client finished sending (ex. HTTP/1.0 client, nc -N), but it waits response.
+	err = app.(*net.TCPConn).CloseWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// EOF is propagated to remote.
+	got, err := io.ReadAll(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "request" {
+		t.Errorf("remote got %q, want request", got)
+	}
+
+	// the other direction still works after half-close.
+	_, err = remote.Write([]byte("response"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote.Close()
+
+	got, err = io.ReadAll(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "response" {
+		t.Errorf("app got %q, want response", got)
+	}
+
+	waitForward(t, done, 2*time.Second)
+
+	if sent := atomic.LoadInt64(&counters.bytesSent); sent != int64(len("request")) {
+		t.Errorf("bytes sent is %d, want %d", sent, len("request"))
+	}
+	if received := atomic.LoadInt64(&counters.bytesReceived); received != int64(len("response")) {
+		t.Errorf("bytes received is %d, want %d", received, len("response"))
+	}
+	if active := atomic.LoadInt64(&counters.activeConnections); active != 0 {
+		t.Errorf("active connections is %d, want 0", active)
+	}
+	if len(errChan) != 0 {
+		t.Errorf("unexpected error: %v", <-errChan)
+	}
+}
+
+func TestForwardIdleTimeout(t *testing.T) {
+	const idleTimeout = 300 * time.Millisecond
+	app, remote, _, errChan, done := startForward(t, ForwardingOptions{IdleTimeout: idleTimeout})
+
+	// traffic resets idle timer.
+	buf := make([]byte, 4)
+	for i := 0; i < 4; i++ {
+		time.Sleep(idleTimeout / 2)
+		if _, err := app.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(remote, buf); err != nil {
+			t.Fatalf("connection is closed while active: %v", err)
+		}
+	}
+
+	elapsed := waitForward(t, done, 2*time.Second)
+	if elapsed < idleTimeout-50*time.Millisecond {
+		t.Errorf("closed after %v, want after idle timeout %v", elapsed, idleTimeout)
+	}
+
+	// both sides are closed.
+	app.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := app.Read(buf); err == nil {
+		t.Error("app connection is not closed")
+	}
+
+	// closed by idle timeout is not error.
+	if len(errChan) != 0 {
+		t.Errorf("unexpected error: %v", <-errChan)
+	}
+}
+
+func TestForwardMaxLifetime(t *testing.T) {
+	const maxLifetime = 500 * time.Millisecond
+	app, remote, _, errChan, done := startForward(t, ForwardingOptions{MaxLifetime: maxLifetime})
+
+	// keep sending, so it is not idle.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+			if _, err := app.Write([]byte("ping")); err != nil {
+				return
+			}
+		}
+	}()
+	go io.Copy(io.Discard, remote)
+
+	elapsed := waitForward(t, done, 3*time.Second)
+	if elapsed < maxLifetime-100*time.Millisecond || elapsed > maxLifetime+500*time.Millisecond {
+		t.Errorf("closed after %v, want about max lifetime %v", elapsed, maxLifetime)
+	}
+
+	if len(errChan) != 0 {
+		t.Errorf("unexpected error: %v", <-errChan)
+	}
+}
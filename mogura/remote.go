@@ -0,0 +1,134 @@
+package mogura
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	DIRECTION_LOCAL  = "local"
+	DIRECTION_REMOTE = "remote"
+
+	RemoteListenRetryInterval = 5 * time.Second
+)
+
+// listenRemote requests the bastion to listen RemoteBindAddress (like ssh -R).
+func (m *Mogura) listenRemote() (*ssh.Client, error) {
+	client := m.bastion.Client()
+	if client == nil {
+		return nil, fmt.Errorf("bastion %s connection is closed.", m.bastion.Config.Name)
+	}
+
+	l, err := client.Listen("tcp", m.Config.RemoteBindAddress)
+	if err != nil {
+		return client, fmt.Errorf("remote port binding failed: %v", err)
+	}
+
+	m.remoteListenerMutex.Lock()
+	defer m.remoteListenerMutex.Unlock()
+	select {
+	case <-m.remoteDoneChan:
+		// tunnel closed while listening.
+		l.Close()
+		return nil, fmt.Errorf("tunnel is closed.")
+	default:
+	}
+	m.remoteListener = l
+
+	return client, nil
+}
+
+func (m *Mogura) closeRemoteListener() error {
+	m.remoteListenerMutex.Lock()
+	defer m.remoteListenerMutex.Unlock()
+
+	if m.remoteListener == nil {
+		return nil
+	}
+
+	err := m.remoteListener.Close()
+	m.remoteListener = nil
+	return err
+}
+
+// remoteAcceptLoop accepts connections on the bastion and forwards to local target.
+// when ssh connection is dead, then reconnects bastion and listens again.
+func (m *Mogura) remoteAcceptLoop(ctx context.Context, client *ssh.Client) {
+	for {
+		m.remoteListenerMutex.Lock()
+		l := m.remoteListener
+		m.remoteListenerMutex.Unlock()
+		if l == nil {
+			return
+		}
+
+		remoteConn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-m.remoteDoneChan:
+				return
+			default:
+				m.errChan <- fmt.Errorf("remote listen.Accept failed: %v", err)
+				m.closeRemoteListener()
+
+				client = m.relistenRemote(client)
+				if client == nil {
+					// tunnel closed
+					return
+				}
+				continue
+			}
+		}
+
+		m.counters.connectionAccepted()
+
+		localConn, err := net.Dial(m.Config.ForwardingTarget.Network(), m.DetectedRemote())
+		if err != nil {
+			m.counters.dialFailed()
+			m.errChan <- fmt.Errorf("local dial failed: %v", err)
+
+			// close remote connection that already accepted. remote client wait forever if this close forgot.
+			remoteConn.Close()
+			continue
+		}
+
+		// go forwarding
+		m.goSending(func() {
+			forward(ctx, localConn, remoteConn, m.Config.Forwarding, &m.counters, m.errChan)
+		})
+	}
+}
+
+// relistenRemote retries remote listening until succeeded or tunnel closed.
+// failed is the client that listener was on. returns new client, or nil if tunnel closed.
+func (m *Mogura) relistenRemote(failed *ssh.Client) *ssh.Client {
+	for {
+		// ssh connection is dead? other tunnel may already reconnected, then it is no-op.
+		sshErr := m.bastion.Reconnect(failed)
+		if sshErr != nil {
+			m.errChan <- fmt.Errorf("failed ssh reconnect: %v", sshErr)
+		} else {
+			client, err := m.listenRemote()
+			if err == nil {
+				return client
+			}
+			m.errChan <- err
+
+			// listen request was denied (ex. port is in use), then ssh connection is alive.
+			if client != nil && !strings.Contains(err.Error(), "denied") {
+				failed = client
+			}
+		}
+
+		select {
+		case <-m.remoteDoneChan:
+			return nil
+		case <-time.After(RemoteListenRetryInterval):
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package mogura
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SOCKS5 protocol values. refs RFC 1928 and RFC 1929
+const (
+	socks5Version = 0x05
+
+	socks5MethodNoAuth       = 0x00
+	socks5MethodUserPass     = 0x02
+	socks5MethodNoAcceptable = 0xff
+
+	socks5UserPassVersion = 0x01
+
+	socks5CmdConnect = 0x01
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5ReplySucceeded           = 0x00
+	socks5ReplyGeneralFailure      = 0x01
+	socks5ReplyNotAllowed          = 0x02
+	socks5ReplyHostUnreachable     = 0x04
+	socks5ReplyConnectionRefused   = 0x05
+	socks5ReplyCommandNotSupported = 0x07
+	socks5ReplyAddressNotSupported = 0x08
+
+	socks5HandshakeTimeout = 10 * time.Second
+)
+
+// Socks5Config is settings for dynamic forwarding tunnel like ssh -D.
+type Socks5Config struct {
+	// local side username/password auth. empty is no auth.
+	Username string
+	Password string
+
+	// resolve domain name with RemoteDNS via DNSClient.
+	// false is resolved by bastion sshd.
+	UseRemoteDNS bool
+}
+
+// socks5Handshake negotiates auth and reads CONNECT request, and returns destination host:port.
+// reply is not sent yet, caller must send reply with socks5Reply.
+func socks5Handshake(conn net.Conn, c Socks5Config) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", fmt.Errorf("read socks5 greeting failed: %v", err)
+	}
+	if header[0] != socks5Version {
+		return "", fmt.Errorf("unsupported socks version %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", fmt.Errorf("read socks5 methods failed: %v", err)
+	}
+
+	method := byte(socks5MethodNoAuth)
+	if c.Username != "" {
+		method = socks5MethodUserPass
+	}
+
+	accepted := false
+	for _, m := range methods {
+		if m == method {
+			accepted = true
+			break
+		}
+	}
+
+	if !accepted {
+		conn.Write([]byte{socks5Version, socks5MethodNoAcceptable})
+		return "", fmt.Errorf("no acceptable socks5 auth method")
+	}
+
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return "", fmt.Errorf("write socks5 method failed: %v", err)
+	}
+
+	if method == socks5MethodUserPass {
+		err := socks5UserPassAuth(conn, c)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// request: VER CMD RSV ATYP
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return "", fmt.Errorf("read socks5 request failed: %v", err)
+	}
+
+	if req[1] != socks5CmdConnect {
+		socks5Reply(conn, socks5ReplyCommandNotSupported)
+		return "", fmt.Errorf("unsupported socks5 command %d", req[1])
+	}
+
+	var host string
+	switch req[3] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		size := net.IPv4len
+		if req[3] == socks5AtypIPv6 {
+			size = net.IPv6len
+		}
+
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", fmt.Errorf("read socks5 address failed: %v", err)
+		}
+		host = net.IP(ip).String()
+	case socks5AtypDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", fmt.Errorf("read socks5 domain failed: %v", err)
+		}
+
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", fmt.Errorf("read socks5 domain failed: %v", err)
+		}
+		host = string(domain)
+	default:
+		socks5Reply(conn, socks5ReplyAddressNotSupported)
+		return "", fmt.Errorf("unsupported socks5 address type %d", req[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", fmt.Errorf("read socks5 port failed: %v", err)
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func socks5UserPassAuth(conn net.Conn, c Socks5Config) error {
+	// VER ULEN UNAME PLEN PASSWD
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("read socks5 auth failed: %v", err)
+	}
+	if header[0] != socks5UserPassVersion {
+		return fmt.Errorf("unsupported socks5 auth version %d", header[0])
+	}
+
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return fmt.Errorf("read socks5 username failed: %v", err)
+	}
+
+	plen := make([]byte, 1)
+	if _, err := io.ReadFull(conn, plen); err != nil {
+		return fmt.Errorf("read socks5 password failed: %v", err)
+	}
+
+	password := make([]byte, plen[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return fmt.Errorf("read socks5 password failed: %v", err)
+	}
+
+	if string(username) != c.Username || string(password) != c.Password {
+		conn.Write([]byte{socks5UserPassVersion, 0x01})
+		return fmt.Errorf("socks5 auth failed for user %s", username)
+	}
+
+	_, err := conn.Write([]byte{socks5UserPassVersion, 0x00})
+	return err
+}
+
+// socks5Reply sends reply. bound address is always 0.0.0.0:0, because it is on the bastion side.
+func socks5Reply(conn net.Conn, rep byte) error {
+	_, err := conn.Write([]byte{socks5Version, rep, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func (m *Mogura) socks5AcceptLoop(ctx context.Context, listener net.Listener) {
+	for {
+		localConn := m.acceptLocal(listener)
+		if localConn == nil {
+			return
+		}
+
+		m.counters.connectionAccepted()
+		m.goSending(func() {
+			m.handleSocks5(ctx, localConn)
+		})
+	}
+}
+
+func (m *Mogura) handleSocks5(ctx context.Context, localConn net.Conn) {
+	localConn.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+	addr, err := socks5Handshake(localConn, m.Config.Socks5)
+	if err != nil {
+		m.errChan <- fmt.Errorf("socks5 handshake failed: %v", err)
+		localConn.Close()
+		return
+	}
+
+	if m.Config.Socks5.UseRemoteDNS {
+		addr, err = m.resolveSocks5Addr(addr)
+		if err != nil {
+			m.counters.resolveFailed()
+			m.errChan <- fmt.Errorf("socks5 resolve failed: %v", err)
+			socks5Reply(localConn, socks5ReplyHostUnreachable)
+			localConn.Close()
+			return
+		}
+	}
+
+	sshConn, err := m.dialRemoteWithReconnect(addr)
+	if err != nil {
+		m.errChan <- fmt.Errorf("socks5 remote dial %s failed: %v", addr, err)
+		socks5Reply(localConn, socks5ReplyFromDialError(err))
+		localConn.Close()
+		return
+	}
+
+	err = socks5Reply(localConn, socks5ReplySucceeded)
+	if err != nil {
+		m.errChan <- fmt.Errorf("socks5 reply failed: %v", err)
+		localConn.Close()
+		sshConn.Close()
+		return
+	}
+	localConn.SetDeadline(time.Time{})
+
+	forward(ctx, localConn, sshConn, m.Config.Forwarding, &m.counters, m.errChan)
+}
+
+// resolveSocks5Addr resolves domain name with RemoteDNS. IP address is returned as is.
+func (m *Mogura) resolveSocks5Addr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+
+	if net.ParseIP(host) != nil {
+		return addr, nil
+	}
+
+	client := m.bastion.Client()
+	if client == nil {
+		return "", fmt.Errorf("bastion %s connection is closed.", m.bastion.Config.Name)
+	}
+
+	ips, _, err := NewDNSClient(client, m.Config.RemoteDNS).QueryIP(host, m.Config.ForwardingTarget.IPFamily)
+	if err != nil {
+		return "", fmt.Errorf("failed %s query to remote DNS: %v", host, err)
+	}
+
+	if len(ips) == 0 {
+		return "", fmt.Errorf("%s answer is empty.", host)
+	}
+
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
+
+func socks5ReplyFromDialError(err error) byte {
+	var openErr *ssh.OpenChannelError
+	if !errors.As(err, &openErr) {
+		return socks5ReplyGeneralFailure
+	}
+
+	switch openErr.Reason {
+	case ssh.Prohibited:
+		return socks5ReplyNotAllowed
+	case ssh.ConnectionFailed:
+		return socks5ReplyConnectionRefused
+	default:
+		return socks5ReplyGeneralFailure
+	}
+}
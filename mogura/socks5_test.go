@@ -0,0 +1,139 @@
+package mogura
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestSocks5Handshake(t *testing.T) {
+	// greeting: VER NMETHODS METHODS
+	noAuth := []byte{socks5Version, 1, socks5MethodNoAuth}
+	userPass := []byte{socks5Version, 2, socks5MethodNoAuth, socks5MethodUserPass}
+	// request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	connectDomain := append([]byte{socks5Version, socks5CmdConnect, 0, socks5AtypDomain, 11}, append([]byte("example.com"), 0x01, 0xbb)...)
+	connectIPv4 := []byte{socks5Version, socks5CmdConnect, 0, socks5AtypIPv4, 10, 0, 0, 1, 0x15, 0x38}
+	connectIPv6 := append(append([]byte{socks5Version, socks5CmdConnect, 0, socks5AtypIPv6}, make([]byte, 15)...), 1, 0x00, 0x50)
+	auth := func(user, pass string) []byte {
+		b := []byte{socks5UserPassVersion, byte(len(user))}
+		b = append(b, user...)
+		b = append(b, byte(len(pass)))
+		return append(b, pass...)
+	}
+	concat := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	failureReply := func(rep byte) []byte {
+		return []byte{socks5Version, rep, 0, socks5AtypIPv4, 0, 0, 0, 0, 0, 0}
+	}
+
+	tests := []struct {
+		name    string
+		config  Socks5Config
+		request []byte
+		want    string
+		wantErr bool
+		// bytes written by server
+		wantReply []byte
+	}{
+		{
+			name:      "no auth domain",
+			request:   concat(noAuth, connectDomain),
+			want:      "example.com:443",
+			wantReply: []byte{socks5Version, socks5MethodNoAuth},
+		},
+		{
+			name:      "no auth IPv4",
+			request:   concat(noAuth, connectIPv4),
+			want:      "10.0.0.1:5432",
+			wantReply: []byte{socks5Version, socks5MethodNoAuth},
+		},
+		{
+			name:      "no auth IPv6",
+			request:   concat(noAuth, connectIPv6),
+			want:      "[::1]:80",
+			wantReply: []byte{socks5Version, socks5MethodNoAuth},
+		},
+		{
+			name:      "user pass",
+			config:    Socks5Config{Username: "alice", Password: "secret"},
+			request:   concat(userPass, auth("alice", "secret"), connectDomain),
+			want:      "example.com:443",
+			wantReply: []byte{socks5Version, socks5MethodUserPass, socks5UserPassVersion, 0x00},
+		},
+		{
+			name:      "wrong password",
+			config:    Socks5Config{Username: "alice", Password: "secret"},
+			request:   concat(userPass, auth("alice", "wrong"), connectDomain),
+			wantErr:   true,
+			wantReply: []byte{socks5Version, socks5MethodUserPass, socks5UserPassVersion, 0x01},
+		},
+		{
+			name:      "client does not support user pass",
+			config:    Socks5Config{Username: "alice", Password: "secret"},
+			request:   noAuth,
+			wantErr:   true,
+			wantReply: []byte{socks5Version, socks5MethodNoAcceptable},
+		},
+		{
+			name:      "unsupported command",
+			request:   concat(noAuth, []byte{socks5Version, 0x02, 0, socks5AtypIPv4, 10, 0, 0, 1, 0, 80}),
+			wantErr:   true,
+			wantReply: concat([]byte{socks5Version, socks5MethodNoAuth}, failureReply(socks5ReplyCommandNotSupported)),
+		},
+		{
+			name:      "unsupported address type",
+			request:   concat(noAuth, []byte{socks5Version, socks5CmdConnect, 0, 0x05}),
+			wantErr:   true,
+			wantReply: concat([]byte{socks5Version, socks5MethodNoAuth}, failureReply(socks5ReplyAddressNotSupported)),
+		},
+		{
+			name:    "socks4",
+			request: []byte{0x04, socks5CmdConnect, 0, 80, 10, 0, 0, 1, 0},
+			wantErr: true,
+		},
+		{
+			name:      "truncated request",
+			request:   concat(noAuth, []byte{socks5Version, socks5CmdConnect}),
+			wantErr:   true,
+			wantReply: []byte{socks5Version, socks5MethodNoAuth},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := tcpPair(t)
+			_, err := client.Write(tt.request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// truncated request gets EOF instead of waiting.
+			client.(*net.TCPConn).CloseWrite()
+
+			got, err := socks5Handshake(server, tt.config)
+			// half-close, because close with unread request resets connection.
+			server.(*net.TCPConn).CloseWrite()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("socks5Handshake() = %s, want error", got)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("socks5Handshake() error: %v", err)
+				}
+				if got != tt.want {
+					t.Errorf("socks5Handshake() = %s, want %s", got, tt.want)
+				}
+			}
+
+			reply, err := io.ReadAll(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(reply, tt.wantReply) {
+				t.Errorf("reply is %v, want %v", reply, tt.wantReply)
+			}
+		})
+	}
+}
@@ -1,13 +1,91 @@
 package mogura
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
+	"os"
+	"time"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
-func GenSSHClientConfig(hostport, username, keyPath, passphrase string) (*ssh.ClientConfig, error) {
+const (
+	ENV_SSH_AUTH_SOCK = "SSH_AUTH_SOCK"
+
+	// TCP connect and ssh handshake timeout of each hop.
+	DEFAULT_SSH_CONNECT_TIMEOUT = 15 * time.Second
+)
+
+func GenSSHClientConfig(hostport, username string, auth ssh.AuthMethod, knownHostsPath string, trustOnFirstUse bool) (*ssh.ClientConfig, error) {
+	hostKeyCallback, err := NewHostKeyCallback(knownHostsPath, trustOnFirstUse)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create sshClientConfig
+	sshConfig := &ssh.ClientConfig{
+		User: username,
+		Auth: []ssh.AuthMethod{
+			auth,
+		},
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: KnownHostKeyAlgorithms(knownHostsPath, hostport),
+		Timeout:           DEFAULT_SSH_CONNECT_TIMEOUT,
+	}
+
+	return sshConfig, nil
+}
+
+// GenAuthMethod returns public key auth method.
+// if useAgent is false, then it uses only private key file.
+// if useAgent is true, then it uses ssh-agent signers first and private key file is fallback.
+// agent signer is only the identity of keyPath (or first identity if keyPath is empty) without agentTryAll.
+// returned closer must be closed after ssh handshake, because agent signers sign via agent connection.
+func GenAuthMethod(keyPath, passphrase string, useAgent, agentTryAll bool) (ssh.AuthMethod, io.Closer, error) {
+	if !useAgent {
+		signer, err := loadKeyFileSigner(keyPath, passphrase)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return ssh.PublicKeys(signer), ioutil.NopCloser(nil), nil
+	}
+
+	signers := make([]ssh.Signer, 0)
+	var closer io.Closer = ioutil.NopCloser(nil)
+
+	agentSigners, agentConn, agentErr := loadAgentSigners(keyPath, agentTryAll)
+	if agentErr != nil {
+		Logger().Warn("ssh-agent is not available", LOG_KEY_ERROR, agentErr)
+	} else {
+		signers = append(signers, agentSigners...)
+		closer = agentConn
+	}
+
+	// fallback private key file
+	if keyPath != "" {
+		signer, err := loadKeyFileSigner(keyPath, passphrase)
+		if err != nil {
+			Logger().Warn("private key fallback is not available", LOG_KEY_ERROR, err)
+		} else {
+			signers = append(signers, signer)
+		}
+	}
+
+	if len(signers) == 0 {
+		closer.Close()
+		return nil, nil, fmt.Errorf("no ssh key available from ssh-agent and key_path.")
+	}
+
+	// all signers in one auth method, because ssh client does not retry same auth method "publickey".
+	return ssh.PublicKeys(signers...), closer, nil
+}
+
+func loadKeyFileSigner(keyPath, passphrase string) (ssh.Signer, error) {
 	key, err := ioutil.ReadFile(keyPath)
 	if err != nil {
 		return nil, fmt.Errorf("unable to read private key: %v", err)
@@ -24,15 +102,166 @@ func GenSSHClientConfig(hostport, username, keyPath, passphrase string) (*ssh.Cl
 		return nil, fmt.Errorf("unable to parse private key: %v", err)
 	}
 
-	// Create sshClientConfig
-	sshConfig := &ssh.ClientConfig{
-		User: username,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
-		},
-		//HostKeyCallback: mogura.FixedHostKey(hostKey),
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	return signer, nil
+}
+
+func loadAgentSigners(keyPath string, tryAll bool) ([]ssh.Signer, net.Conn, error) {
+	sock := os.Getenv(ENV_SSH_AUTH_SOCK)
+	if sock == "" {
+		return nil, nil, fmt.Errorf("%s is not set", ENV_SSH_AUTH_SOCK)
 	}
 
-	return sshConfig, nil
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can not connect ssh-agent: %v", err)
+	}
+
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("can not get identities from ssh-agent: %v", err)
+	}
+
+	if len(signers) == 0 {
+		conn.Close()
+		return nil, nil, fmt.Errorf("ssh-agent has no identities")
+	}
+
+	if tryAll {
+		return signers, conn, nil
+	}
+
+	if keyPath == "" {
+		return signers[:1], conn, nil
+	}
+
+	pub, err := loadPublicKey(keyPath)
+	if err != nil {
+		// can not detect which identity is key_path, so try all.
+		Logger().Warn("can not load public key, try all ssh-agent identities", "key_path", keyPath, LOG_KEY_ERROR, err)
+		return signers, conn, nil
+	}
+
+	for _, s := range signers {
+		if bytes.Equal(s.PublicKey().Marshal(), pub.Marshal()) {
+			return []ssh.Signer{s}, conn, nil
+		}
+	}
+
+	conn.Close()
+	return nil, nil, fmt.Errorf("ssh-agent does not have identity of %s", keyPath)
+}
+
+// loadPublicKey loads public key from keyPath.pub or unencrypted private key.
+func loadPublicKey(keyPath string) (ssh.PublicKey, error) {
+	pubBytes, err := ioutil.ReadFile(keyPath + ".pub")
+	if err == nil {
+		pub, _, _, _, err := ssh.ParseAuthorizedKey(pubBytes)
+		return pub, err
+	}
+
+	key, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return signer.PublicKey(), nil
+}
+
+// SSHHop is ssh server setting in ProxyJump chain.
+type SSHHop struct {
+	HostPort        string
+	Username        string
+	KeyPath         string
+	UseAgent        bool
+	AgentTryAll     bool
+	KnownHostsPath  string
+	TrustOnFirstUse bool
+}
+
+// DialChain connects hops in order. first hop is dialed directly, and next hop is dialed through previous hop.
+// returned clients are same order as hops, last client is connection to last hop.
+// if any hop failed, then already connected clients are closed.
+func DialChain(hops []SSHHop, passphrase string) ([]*ssh.Client, error) {
+	if len(hops) == 0 {
+		return nil, fmt.Errorf("no ssh host.")
+	}
+
+	clients := make([]*ssh.Client, 0, len(hops))
+	for i, hop := range hops {
+		var prev *ssh.Client
+		if i > 0 {
+			prev = clients[i-1]
+		}
+
+		client, err := dialHop(prev, hop, passphrase)
+		if err != nil {
+			CloseChain(clients)
+			if len(hops) > 1 {
+				return nil, fmt.Errorf("hop %d %s: %v", i+1, hop.HostPort, err)
+			}
+			return nil, err
+		}
+
+		clients = append(clients, client)
+	}
+
+	return clients, nil
+}
+
+// CloseChain closes clients from last hop.
+func CloseChain(clients []*ssh.Client) {
+	for i := len(clients) - 1; i >= 0; i-- {
+		clients[i].Close()
+	}
+}
+
+func dialHop(prev *ssh.Client, hop SSHHop, passphrase string) (*ssh.Client, error) {
+	auth, authCloser, err := GenAuthMethod(hop.KeyPath, passphrase, hop.UseAgent, hop.AgentTryAll)
+	if err != nil {
+		return nil, fmt.Errorf("ssh auth error: %v", err)
+	}
+	// agent connection is needed until handshake finished.
+	defer authCloser.Close()
+
+	clientConfig, err := GenSSHClientConfig(hop.HostPort, hop.Username, auth, hop.KnownHostsPath, hop.TrustOnFirstUse)
+	if err != nil {
+		return nil, fmt.Errorf("ssh config error: %v", err)
+	}
+
+	var conn net.Conn
+	if prev == nil {
+		conn, err = net.DialTimeout("tcp", hop.HostPort, clientConfig.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("ssh.Dial failed: %v", err)
+		}
+	} else {
+		conn, err = prev.Dial("tcp", hop.HostPort)
+		if err != nil {
+			return nil, fmt.Errorf("jump dial failed: %v", err)
+		}
+	}
+
+	// handshake has no timeout, and jump connection does not support deadline. so close it when timed out.
+	timer := time.AfterFunc(clientConfig.Timeout, func() {
+		conn.Close()
+	})
+	c, chans, reqs, err := ssh.NewClientConn(conn, hop.HostPort, clientConfig)
+	if !timer.Stop() {
+		if err == nil {
+			c.Close()
+		}
+		return nil, fmt.Errorf("ssh handshake failed: timeout after %v", clientConfig.Timeout)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("ssh handshake failed: %v", err)
+	}
+
+	return ssh.NewClient(c, chans, reqs), nil
 }
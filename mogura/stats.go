@@ -0,0 +1,110 @@
+package mogura
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is snapshot of tunnel state.
+type Stats struct {
+	Name             string `json:"name"`
+	Bastion          string `json:"bastion"`
+	BastionConnected bool   `json:"bastion_connected"`
+	DetectedRemote   string `json:"detected_remote"`
+	// all resolved targets, SRV may have multiple targets.
+	Endpoints []string `json:"endpoints,omitempty"`
+
+	ActiveConnections int64 `json:"active_connections"`
+	TotalConnections  int64 `json:"total_connections"`
+	// local -> remote
+	BytesSent int64 `json:"bytes_sent"`
+	// remote -> local
+	BytesReceived int64 `json:"bytes_received"`
+
+	DialFailures    int64 `json:"dial_failures"`
+	ResolveFailures int64 `json:"resolve_failures"`
+	TargetChanges   int64 `json:"target_changes"`
+	// reconnects of the bastion that is shared by tunnels.
+	BastionReconnects int64 `json:"bastion_reconnects"`
+
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at,omitempty"`
+}
+
+// tunnelCounters are updated by forwarding goroutines.
+type tunnelCounters struct {
+	activeConnections int64
+	totalConnections  int64
+	bytesSent         int64
+	bytesReceived     int64
+	dialFailures      int64
+	resolveFailures   int64
+	targetChanges     int64
+
+	lastErrorMutex sync.Mutex
+	lastError      string
+	lastErrorAt    time.Time
+}
+
+// connectionAccepted counts accepted connection including failed to dial target.
+func (c *tunnelCounters) connectionAccepted() {
+	atomic.AddInt64(&c.totalConnections, 1)
+}
+
+func (c *tunnelCounters) connectionOpened() {
+	atomic.AddInt64(&c.activeConnections, 1)
+}
+
+func (c *tunnelCounters) connectionClosed() {
+	atomic.AddInt64(&c.activeConnections, -1)
+}
+
+func (c *tunnelCounters) dialFailed() {
+	atomic.AddInt64(&c.dialFailures, 1)
+}
+
+func (c *tunnelCounters) resolveFailed() {
+	atomic.AddInt64(&c.resolveFailures, 1)
+}
+
+func (c *tunnelCounters) targetChanged() {
+	atomic.AddInt64(&c.targetChanges, 1)
+}
+
+func (c *tunnelCounters) recordError(err error) {
+	c.lastErrorMutex.Lock()
+	defer c.lastErrorMutex.Unlock()
+
+	c.lastError = err.Error()
+	c.lastErrorAt = time.Now()
+}
+
+// Stats returns current tunnel state.
+func (m *Mogura) Stats() Stats {
+	s := Stats{
+		Name:              m.Config.Name,
+		Bastion:           m.bastion.Config.Name,
+		BastionConnected:  m.bastion.Connected(),
+		DetectedRemote:    m.DetectedRemote(),
+		ActiveConnections: atomic.LoadInt64(&m.counters.activeConnections),
+		TotalConnections:  atomic.LoadInt64(&m.counters.totalConnections),
+		BytesSent:         atomic.LoadInt64(&m.counters.bytesSent),
+		BytesReceived:     atomic.LoadInt64(&m.counters.bytesReceived),
+		DialFailures:      atomic.LoadInt64(&m.counters.dialFailures),
+		ResolveFailures:   atomic.LoadInt64(&m.counters.resolveFailures),
+		TargetChanges:     atomic.LoadInt64(&m.counters.targetChanges),
+		BastionReconnects: m.bastion.Reconnects(),
+	}
+
+	for _, e := range m.Endpoints() {
+		s.Endpoints = append(s.Endpoints, e.HostPort())
+	}
+
+	m.counters.lastErrorMutex.Lock()
+	s.LastError = m.counters.lastError
+	s.LastErrorAt = m.counters.lastErrorAt
+	m.counters.lastErrorMutex.Unlock()
+
+	return s
+}
@@ -3,21 +3,54 @@ package mogura
 import (
 	"fmt"
 	"golang.org/x/crypto/ssh"
-	"log"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
+const (
+	// unix domain socket path in the bastion
+	TARGET_TYPE_UNIX = "UNIX"
+
+	IP_FAMILY_V4  = "v4"
+	IP_FAMILY_V6  = "v6"
+	IP_FAMILY_ANY = "any"
+)
+
 type Target struct {
 	TargetType string
 	Target     string
 	TargetPort int
-
-	ForwardingTimeout time.Duration
+	// IP_FAMILY_V4(default), IP_FAMILY_V6 or IP_FAMILY_ANY for resolving SRV targets.
+	IPFamily string
 
 	resolvedTarget string
 	resolvedPort   string
-	ttl            int
+	// minimum TTL of resolved records (seconds)
+	ttl uint32
+
+	// all resolved endpoints. SRV target may have multiple endpoints.
+	endpoints []Endpoint
+}
+
+// Endpoint is resolved forwarding destination.
+type Endpoint struct {
+	Host string
+	Port int
+
+	// SRV priority and weight. refs RFC 2782
+	Priority uint16
+	Weight   uint16
+	// SRV target name. addresses of same SRV target share the weight.
+	SRVTarget string
+}
+
+func (e Endpoint) HostPort() string {
+	return net.JoinHostPort(e.Host, strconv.Itoa(e.Port))
 }
 
 func (t *Target) Validate() error {
@@ -34,6 +67,13 @@ func (t *Target) Validate() error {
 		if t.TargetPort != 0 {
 			return fmt.Errorf("target port is specifeid, however target type SRV.")
 		}
+	case TARGET_TYPE_UNIX:
+		if t.TargetPort != 0 {
+			return fmt.Errorf("target port is specifeid, however target is unix socket.")
+		}
+		if !strings.HasPrefix(t.Target, "/") {
+			return fmt.Errorf("target socket must be absolute path.")
+		}
 	case "HOST-IP":
 		fallthrough
 	default:
@@ -42,16 +82,22 @@ func (t *Target) Validate() error {
 		}
 	}
 
+	switch t.IPFamily {
+	case "", IP_FAMILY_V4, IP_FAMILY_V6, IP_FAMILY_ANY:
+	default:
+		return fmt.Errorf("invalid ip_family %s. v4, v6 or any.", t.IPFamily)
+	}
+
 	return nil
 }
 
-func (t *Target) Resolve(conn *ssh.Client, resolver string) error {
+func (t *Target) Resolve(conn *ssh.Client, remoteDNS DNSOptions, logger *slog.Logger) error {
 	switch t.TargetType {
 	case "CNAME-SRV":
-		client := NewDNSClient(conn, resolver)
+		client := NewDNSClient(conn, remoteDNS)
 		cnames, err := client.QueryCNAME(t.Target)
 		if err != nil {
-			return fmt.Errorf("failed CNAME query to remote DNS: %v", err)
+			return fmt.Errorf("failed CNAME query to remote DNS: %w", err)
 		}
 		if len(cnames) == 0 {
 			return fmt.Errorf("no answer %s", t.Target)
@@ -59,78 +105,259 @@ func (t *Target) Resolve(conn *ssh.Client, resolver string) error {
 
 		// resolve CNAME -> SRV -> A
 		// detect SRV, A record by myself.
-		srvRecords, err := client.QuerySRV(cnames[0].Target)
-		targets, err := client.QueryA(srvRecords[0].Target)
+		err = t.resolveSRV(client, cnames[0].Target, logger)
 		if err != nil {
-			return fmt.Errorf("failed %s A query to remote DNS: %v", srvRecords[0].Target, err)
+			return err
 		}
+		t.ttl = minTTL(t.ttl, cnames[0].Hdr.Ttl)
+
+		return nil
+	case "SRV":
+		// Why do not auto detect AWS ECS ServiceDiscovery A record...?
+		// detect A record by myself.
+		return t.resolveSRV(NewDNSClient(conn, remoteDNS), t.Target, logger)
+	case TARGET_TYPE_UNIX:
+		// socket path has no port and no other endpoint.
+		t.resolvedTarget = t.Target
+		t.resolvedPort = ""
+		t.endpoints = nil
 
-		if len(targets) == 0 {
-			return fmt.Errorf("%s answer is empty.", srvRecords[0].Target)
+		return nil
+	case "HOST-PORT":
+		fallthrough
+	default:
+		// default Host and Port
+		t.resolvedTarget = t.Target
+		t.resolvedPort = strconv.Itoa(t.TargetPort)
+		t.endpoints = []Endpoint{{Host: t.Target, Port: t.TargetPort}}
+
+		return nil
+	}
+}
+
+// resolveSRV resolves SRV record and A records of all SRV targets.
+// current target is kept while it is in the highest priority, otherwise new target is selected by RFC 2782.
+func (t *Target) resolveSRV(client *DNSClient, name string, logger *slog.Logger) error {
+	srvs, err := client.QuerySRV(name)
+	if err != nil {
+		return fmt.Errorf("failed SRV query to remote DNS: %w", err)
+	}
+	if len(srvs) == 0 {
+		return fmt.Errorf("no answer %s", name)
+	}
+
+	ttl := srvs[0].Hdr.Ttl
+	endpoints := make([]Endpoint, 0, len(srvs))
+	for _, srv := range srvs {
+		ttl = minTTL(ttl, srv.Hdr.Ttl)
+		ips, ipTTL, err := client.QueryIP(srv.Target, t.IPFamily)
+		if err != nil {
+			// other SRV targets may be available.
+			logger.Warn("failed address query to remote DNS", LOG_KEY_TARGET, srv.Target, LOG_KEY_ERROR, err)
+			continue
+		}
+		if len(ips) > 0 {
+			ttl = minTTL(ttl, ipTTL)
 		}
 
-		// TODO if priority are same, then shuffle
-		// TODO fix logging...
-		newTarget := targets[0].A.String()
-		newPort := strconv.Itoa(int(srvRecords[0].Port))
+		// weight is for the SRV target, not for each address. see weightedOrder.
+		for _, ip := range ips {
+			endpoints = append(endpoints, Endpoint{
+				Host:      ip.String(),
+				Port:      int(srv.Port),
+				Priority:  srv.Priority,
+				Weight:    srv.Weight,
+				SRVTarget: srv.Target,
+			})
+		}
+	}
 
-		if t.resolvedTarget != newTarget || t.resolvedPort != newPort {
-			log.Printf("resolved CNAME record %s => %s", t.Target, cnames[0].Target)
-			log.Printf("resolved SRV record %s => %s:%d", t.Target, srvRecords[0].Target, srvRecords[0].Port)
-			log.Printf("resolved A record %s => %s", srvRecords[0].Target, targets[0].A.String())
+	if len(endpoints) == 0 {
+		return fmt.Errorf("%s answer is empty.", name)
+	}
 
-			t.resolvedTarget = newTarget
-			t.resolvedPort = newPort
+	if !sameEndpoints(t.endpoints, endpoints) {
+		for _, e := range endpoints {
+			logger.Info("resolved SRV record", LOG_KEY_TARGET, name, LOG_KEY_REMOTE, e.HostPort(), "priority", e.Priority, "weight", e.Weight)
 		}
+	}
+	t.endpoints = endpoints
 
-		// TODO start goroutine that resolve again after ttl
-		return nil
-	case "SRV":
-		client := NewDNSClient(conn, resolver)
-		srvs, err := client.QuerySRV(t.Target)
-		if err != nil {
-			return fmt.Errorf("failed SRV query to remote DNS: %v", err)
+	selected := selectEndpoint(t.ResolvedTargetAndPort(), endpoints)
+	t.resolvedTarget = selected.Host
+	t.resolvedPort = strconv.Itoa(selected.Port)
+	t.ttl = ttl
+
+	return nil
+}
+
+// NeedsResolve returns whether target is resolved by DNS.
+func (t *Target) NeedsResolve() bool {
+	return t.TargetType == "SRV" || t.TargetType == "CNAME-SRV"
+}
+
+// TTL returns minimum TTL of last resolved records. 0 is unknown.
+func (t *Target) TTL() time.Duration {
+	return time.Duration(t.ttl) * time.Second
+}
+
+func minTTL(a, b uint32) uint32 {
+	if b < a {
+		return b
+	}
+	return a
+}
+
+// Network returns network for dial. "unix" or "tcp"
+func (t *Target) Network() string {
+	if t.TargetType == TARGET_TYPE_UNIX {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// HostPort returns configured target and port without resolving. unix socket target is the path.
+func (t *Target) HostPort() string {
+	if t.TargetType == TARGET_TYPE_UNIX {
+		return t.Target
+	}
+
+	return net.JoinHostPort(t.Target, strconv.Itoa(t.TargetPort))
+}
+
+func (t *Target) ResolvedTargetAndPort() string {
+	if t.resolvedTarget == "" {
+		return ""
+	}
+
+	if t.TargetType == TARGET_TYPE_UNIX {
+		return t.resolvedTarget
+	}
+
+	return net.JoinHostPort(t.resolvedTarget, t.resolvedPort)
+}
+
+// Endpoints returns all resolved endpoints.
+func (t *Target) Endpoints() []Endpoint {
+	endpoints := make([]Endpoint, len(t.endpoints))
+	copy(endpoints, t.endpoints)
+
+	return endpoints
+}
+
+// selectEndpoint keeps current endpoint if it is in the highest priority group,
+// because switching target without DNS change breaks session affinity. otherwise selects by RFC 2782.
+func selectEndpoint(current string, endpoints []Endpoint) Endpoint {
+	best := endpoints[0].Priority
+	for _, e := range endpoints {
+		if e.Priority < best {
+			best = e.Priority
 		}
-		if len(srvs) == 0 {
-			return fmt.Errorf("no answer %s", t.Target)
+	}
+
+	for _, e := range endpoints {
+		if e.Priority == best && e.HostPort() == current {
+			return e
 		}
+	}
 
-		// Why do not auto detect AWS ECS ServiceDiscovery A record...?
-		// detect A record by myself.
-		targets, err := client.QueryA(srvs[0].Target)
-		if err != nil {
-			return fmt.Errorf("failed %s A query to remote DNS: %v", srvs[0].Target, err)
+	return OrderEndpoints(endpoints)[0]
+}
+
+// OrderEndpoints returns endpoints in trying order by RFC 2782.
+// lower priority first, and weighted random order in same priority.
+func OrderEndpoints(endpoints []Endpoint) []Endpoint {
+	sorted := make([]Endpoint, len(endpoints))
+	copy(sorted, endpoints)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority < sorted[j].Priority
+	})
+
+	ordered := make([]Endpoint, 0, len(sorted))
+	for i := 0; i < len(sorted); {
+		j := i
+		for j < len(sorted) && sorted[j].Priority == sorted[i].Priority {
+			j++
+		}
+		ordered = append(ordered, weightedOrder(sorted[i:j])...)
+		i = j
+	}
+
+	return ordered
+}
+
+// srvRecord is endpoints of one SRV record (target and port).
+type srvRecord struct {
+	weight    uint16
+	endpoints []Endpoint
+}
+
+// groupBySRVRecord groups endpoints by SRV record in order. endpoint without SRV target is one record.
+func groupBySRVRecord(endpoints []Endpoint) []*srvRecord {
+	records := make([]*srvRecord, 0, len(endpoints))
+	index := make(map[string]*srvRecord, len(endpoints))
+	for _, e := range endpoints {
+		key := e.HostPort()
+		if e.SRVTarget != "" {
+			key = net.JoinHostPort(e.SRVTarget, strconv.Itoa(e.Port))
 		}
 
-		if len(targets) == 0 {
-			return fmt.Errorf("%s answer is empty.", srvs[0].Target)
+		r, exists := index[key]
+		if !exists {
+			r = &srvRecord{weight: e.Weight}
+			index[key] = r
+			records = append(records, r)
 		}
+		r.endpoints = append(r.endpoints, e)
+	}
+
+	return records
+}
 
-		// TODO if priority are same, then shuffle
-		// TODO fix logging...
-		newTarget := targets[0].A.String()
-		newPort := strconv.Itoa(int(srvs[0].Port))
-		if t.resolvedTarget != newTarget || t.resolvedPort != newPort {
-			log.Printf("resolved SRV record %s => %s:%d", t.Target, srvs[0].Target, srvs[0].Port)
-			log.Printf("resolved A record %s => %s", srvs[0].Target, targets[0].A.String())
+// weightedOrder orders same priority endpoints by weighted random selection of SRV records.
+// the record is selected by its weight regardless of the number of addresses, then expanded to its addresses.
+func weightedOrder(group []Endpoint) []Endpoint {
+	remaining := groupBySRVRecord(group)
 
-			t.resolvedTarget = newTarget
-			t.resolvedPort = newPort
+	ordered := make([]Endpoint, 0, len(group))
+	for len(remaining) > 0 {
+		sum := 0
+		for _, r := range remaining {
+			sum += int(r.weight)
 		}
 
-		// TODO start goroutine that resolve again after ttl
-		return nil
-	case "HOST-PORT":
-		fallthrough
-	default:
-		// default Host and Port
-		t.resolvedTarget = t.Target
-		t.resolvedPort = strconv.Itoa(t.TargetPort)
+		// selected in proportion to weight. weight 0 records are selected randomly after weighted records
+		// (same as Go net package, RFC 2782 gives them very small chance).
+		selected := rand.Intn(len(remaining))
+		if sum > 0 {
+			r := rand.Intn(sum)
+			running := 0
+			for k, record := range remaining {
+				running += int(record.weight)
+				if running > r {
+					selected = k
+					break
+				}
+			}
+		}
 
-		return nil
+		ordered = append(ordered, remaining[selected].endpoints...)
+		remaining = append(remaining[:selected], remaining[selected+1:]...)
 	}
+
+	return ordered
 }
 
-func (t *Target) ResolvedTargetAndPort() string {
-	return t.resolvedTarget + ":" + t.resolvedPort
+func sameEndpoints(a, b []Endpoint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
 }
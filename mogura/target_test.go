@@ -0,0 +1,169 @@
+package mogura
+
+import (
+	"math"
+	"testing"
+)
+
+func srvEndpoint(target, host string, priority, weight uint16) Endpoint {
+	return Endpoint{Host: host, Port: 80, Priority: priority, Weight: weight, SRVTarget: target}
+}
+
+func TestOrderEndpointsPriority(t *testing.T) {
+	endpoints := []Endpoint{
+		srvEndpoint("c.", "10.0.0.3", 20, 10),
+		srvEndpoint("a.", "10.0.0.1", 10, 10),
+		srvEndpoint("d.", "10.0.0.4", 30, 0),
+		srvEndpoint("b.", "10.0.0.2", 10, 10),
+	}
+
+	for i := 0; i < 100; i++ {
+		ordered := OrderEndpoints(endpoints)
+		if len(ordered) != len(endpoints) {
+			t.Fatalf("got %d endpoints, want %d", len(ordered), len(endpoints))
+		}
+
+		priorities := []uint16{10, 10, 20, 30}
+		for k, e := range ordered {
+			if e.Priority != priorities[k] {
+				t.Fatalf("ordered[%d] priority is %d, want %d: %v", k, e.Priority, priorities[k], ordered)
+			}
+		}
+	}
+}
+
+func TestWeightedOrderZeroWeight(t *testing.T) {
+	tests := []struct {
+		name  string
+		group []Endpoint
+		// max ratio that zero weight endpoint is first
+		maxZeroFirst float64
+	}{
+		{
+			name: "zero and weighted",
+			group: []Endpoint{
+				srvEndpoint("a.", "10.0.0.1", 10, 100),
+				srvEndpoint("b.", "10.0.0.2", 10, 0),
+			},
+			maxZeroFirst: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const n = 2000
+			zeroFirst := 0
+			for i := 0; i < n; i++ {
+				ordered := weightedOrder(tt.group)
+				if len(ordered) != len(tt.group) {
+					t.Fatalf("got %d endpoints, want %d", len(ordered), len(tt.group))
+				}
+				if ordered[0].Weight == 0 {
+					zeroFirst++
+				}
+			}
+
+			if ratio := float64(zeroFirst) / n; ratio > tt.maxZeroFirst {
+				t.Errorf("zero weight is first in %.3f, want <= %.3f", ratio, tt.maxZeroFirst)
+			}
+		})
+	}
+}
+
+func TestWeightedOrderDistribution(t *testing.T) {
+	tests := []struct {
+		name  string
+		group []Endpoint
+		// expected ratio that SRV target is first
+		want map[string]float64
+	}{
+		{
+			name: "weight 1:3",
+			group: []Endpoint{
+				srvEndpoint("a.", "10.0.0.1", 10, 1),
+				srvEndpoint("b.", "10.0.0.2", 10, 3),
+			},
+			want: map[string]float64{"a.": 0.25, "b.": 0.75},
+		},
+		{
+			name: "weight is per SRV target, not per address",
+			group: []Endpoint{
+				srvEndpoint("a.", "10.0.0.1", 10, 10),
+				srvEndpoint("a.", "10.0.0.2", 10, 10),
+				srvEndpoint("a.", "10.0.0.3", 10, 10),
+				srvEndpoint("b.", "10.0.0.4", 10, 10),
+			},
+			want: map[string]float64{"a.": 0.5, "b.": 0.5},
+		},
+		{
+			name: "all zero is random",
+			group: []Endpoint{
+				srvEndpoint("a.", "10.0.0.1", 10, 0),
+				srvEndpoint("b.", "10.0.0.2", 10, 0),
+			},
+			want: map[string]float64{"a.": 0.5, "b.": 0.5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const n = 10000
+			first := make(map[string]int)
+			for i := 0; i < n; i++ {
+				ordered := weightedOrder(tt.group)
+				first[ordered[0].SRVTarget]++
+
+				// addresses of the SRV target are not split.
+				seen := make(map[string]bool)
+				for k, e := range ordered {
+					if seen[e.SRVTarget] && ordered[k-1].SRVTarget != e.SRVTarget {
+						t.Fatalf("addresses of %s are split: %v", e.SRVTarget, ordered)
+					}
+					seen[e.SRVTarget] = true
+				}
+			}
+
+			for target, want := range tt.want {
+				got := float64(first[target]) / n
+				if math.Abs(got-want) > 0.03 {
+					t.Errorf("%s is first in %.3f, want %.3f", target, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSelectEndpoint(t *testing.T) {
+	endpoints := []Endpoint{
+		srvEndpoint("a.", "10.0.0.1", 10, 10),
+		srvEndpoint("b.", "10.0.0.2", 10, 10),
+		srvEndpoint("c.", "10.0.0.3", 20, 10),
+	}
+
+	tests := []struct {
+		name    string
+		current string
+		// allowed selected hosts
+		want []string
+	}{
+		{name: "keep current in highest priority", current: "10.0.0.2:80", want: []string{"10.0.0.2"}},
+		{name: "switch from lower priority", current: "10.0.0.3:80", want: []string{"10.0.0.1", "10.0.0.2"}},
+		{name: "current is gone", current: "10.0.0.9:80", want: []string{"10.0.0.1", "10.0.0.2"}},
+		{name: "first resolve", current: "", want: []string{"10.0.0.1", "10.0.0.2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				selected := selectEndpoint(tt.current, endpoints)
+				ok := false
+				for _, host := range tt.want {
+					ok = ok || selected.Host == host
+				}
+				if !ok {
+					t.Fatalf("selected %s, want one of %v", selected.Host, tt.want)
+				}
+			}
+		})
+	}
+}
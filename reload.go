@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/reiki4040/mogura/mogura"
+)
+
+const (
+	WATCH_CONFIG_INTERVAL = 2 * time.Second
+)
+
+// reloadLoop reloads config on SIGHUP from hupChan, or config file changed if watch is true.
+// onReload is called after tunnels are reloaded. it returns when ctx is done.
+func reloadLoop(ctx context.Context, confPath string, manager *TunnelManager, watch bool, hupChan <-chan os.Signal, onReload func()) {
+	var watchC <-chan time.Time
+	lastModified := configModTime(confPath)
+	if watch {
+		ticker := time.NewTicker(WATCH_CONFIG_INTERVAL)
+		defer ticker.Stop()
+		watchC = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hupChan:
+			slog.Info("got SIGHUP, reloading config", "path", confPath)
+		case <-watchC:
+			modified := configModTime(confPath)
+			if modified.IsZero() || modified.Equal(lastModified) {
+				continue
+			}
+			slog.Info("config is changed, reloading", "path", confPath)
+		}
+
+		lastModified = configModTime(confPath)
+		if reloadConfig(confPath, manager) && onReload != nil {
+			onReload()
+		}
+	}
+}
+
+// reloadConfig applies config to running tunnels. if config is invalid, then running tunnels are kept and returns false.
+func reloadConfig(confPath string, manager *TunnelManager) bool {
+	c, err := LoadConfig(confPath)
+	if err != nil {
+		slog.Error("reload failed, keep current tunnels. can not load config file", "path", confPath, mogura.LOG_KEY_ERROR, err)
+		return false
+	}
+
+	tunnels, err := buildTunnels(c)
+	if err != nil {
+		slog.Error("reload failed, keep current tunnels.", mogura.LOG_KEY_ERROR, err)
+		return false
+	}
+
+	if len(tunnels) < len(c.Tunnels) {
+		slog.Warn("some tunnels are invalid. those tunnel were not started.")
+	}
+
+	manager.Reload(tunnels)
+	return true
+}
+
+func configModTime(path string) time.Time {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return fi.ModTime()
+}
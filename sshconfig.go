@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	DEFAULT_SSH_CONFIG_PATH = "~/.ssh/config"
+
+	// same limit as OpenSSH
+	maxSSHConfigIncludeDepth = 16
+)
+
+// SSHConfigHost is values for a host in ssh config (~/.ssh/config).
+// empty value is not specified in ssh config.
+type SSHConfigHost struct {
+	HostName           string
+	User               string
+	Port               int
+	IdentityFile       string
+	ProxyJump          string
+	UserKnownHostsFile string
+	// seconds
+	ServerAliveInterval int
+	ServerAliveCountMax int
+}
+
+type sshConfigEntry struct {
+	// nil is global entry (before any Host line), it matches all host.
+	patterns []string
+	key      string
+	value    string
+}
+
+// SSHConfigFile is parsed ssh config.
+// it supports Host (wildcard and negation patterns) and Include. Match blocks are ignored.
+type SSHConfigFile struct {
+	entries []sshConfigEntry
+
+	// base directory of relative Include.
+	sshDir string
+}
+
+func LoadSSHConfig(path string) (*SSHConfigFile, error) {
+	return loadSSHConfig(path, "~/.ssh")
+}
+
+func loadSSHConfig(path, sshDir string) (*SSHConfigFile, error) {
+	f := &SSHConfigFile{sshDir: sshDir}
+	err := f.parseFile(path, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *SSHConfigFile) parseFile(path string, patterns []string, depth int) error {
+	if depth > maxSSHConfigIncludeDepth {
+		return fmt.Errorf("too deep Include in %s", path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	lineNum := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineNum++
+		key, value := splitSSHConfigLine(scanner.Text())
+		if key == "" {
+			continue
+		}
+
+		switch key {
+		case "host":
+			patterns = strings.Fields(value)
+		case "match":
+			// Match is not supported. it never matches.
+			patterns = []string{}
+		case "include":
+			for _, inc := range strings.Fields(value) {
+				err := f.include(inc, patterns, depth)
+				if err != nil {
+					return fmt.Errorf("%s:%d: %v", path, lineNum, err)
+				}
+			}
+		default:
+			f.entries = append(f.entries, sshConfigEntry{
+				patterns: patterns,
+				key:      key,
+				value:    strings.Trim(value, `"`),
+			})
+		}
+	}
+
+	return scanner.Err()
+}
+
+func (f *SSHConfigFile) include(pattern string, patterns []string, depth int) error {
+	path, err := ResolveUserHome(pattern)
+	if err != nil {
+		return err
+	}
+
+	// relative path is in ~/.ssh like OpenSSH user config.
+	if !filepath.IsAbs(path) {
+		sshDir, err := ResolveUserHome(f.sshDir)
+		if err != nil {
+			return err
+		}
+		path = filepath.Join(sshDir, path)
+	}
+
+	files, err := filepath.Glob(path)
+	if err != nil {
+		return fmt.Errorf("invalid Include %s: %v", pattern, err)
+	}
+
+	for _, file := range files {
+		err := f.parseFile(file, patterns, depth+1)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Lookup returns values for host. first obtained value is used like ssh.
+func (f *SSHConfigFile) Lookup(host string) SSHConfigHost {
+	values := make(map[string]string)
+	for _, e := range f.entries {
+		if _, exists := values[e.key]; exists {
+			continue
+		}
+
+		if e.patterns == nil || matchSSHHostPatterns(e.patterns, host) {
+			values[e.key] = e.value
+		}
+	}
+
+	h := SSHConfigHost{
+		HostName:  values["hostname"],
+		User:      values["user"],
+		ProxyJump: values["proxyjump"],
+	}
+
+	// UserKnownHostsFile may have multiple files, use first one.
+	if files := strings.Fields(values["userknownhostsfile"]); len(files) > 0 {
+		h.UserKnownHostsFile = files[0]
+	}
+
+	if p, err := strconv.Atoi(values["port"]); err == nil {
+		h.Port = p
+	}
+
+	if i, err := strconv.Atoi(values["serveraliveinterval"]); err == nil {
+		h.ServerAliveInterval = i
+	}
+
+	if c, err := strconv.Atoi(values["serveralivecountmax"]); err == nil {
+		h.ServerAliveCountMax = c
+	}
+
+	if h.HostName != "" {
+		h.HostName = strings.ReplaceAll(h.HostName, "%h", host)
+	}
+
+	remoteUser := h.User
+	if remoteUser == "" {
+		if u, err := user.Current(); err == nil {
+			remoteUser = u.Username
+		}
+	}
+	if values["identityfile"] != "" {
+		h.IdentityFile = expandSSHConfigTokens(values["identityfile"], host, remoteUser)
+	}
+	if h.UserKnownHostsFile != "" {
+		h.UserKnownHostsFile = expandSSHConfigTokens(h.UserKnownHostsFile, host, remoteUser)
+	}
+
+	return h
+}
+
+// splitSSHConfigLine returns lower case keyword and value. "Key Value" and "Key=Value" are allowed.
+func splitSSHConfigLine(line string) (string, string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", ""
+	}
+
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return strings.ToLower(line), ""
+	}
+
+	key := strings.ToLower(line[:i])
+	value := strings.TrimSpace(line[i:])
+	value = strings.TrimSpace(strings.TrimPrefix(value, "="))
+
+	return key, value
+}
+
+func matchSSHHostPatterns(patterns []string, host string) bool {
+	matched := false
+	for _, p := range patterns {
+		if strings.HasPrefix(p, "!") {
+			if matchWildcard(p[1:], host) {
+				// negated match always wins.
+				return false
+			}
+			continue
+		}
+
+		for _, sp := range strings.Split(p, ",") {
+			if matchWildcard(sp, host) {
+				matched = true
+			}
+		}
+	}
+
+	return matched
+}
+
+// matchWildcard matches ssh config pattern. '*' is zero or more characters and '?' is one character.
+func matchWildcard(pattern, s string) bool {
+	if pattern == "" {
+		return s == ""
+	}
+
+	switch pattern[0] {
+	case '*':
+		for i := 0; i <= len(s); i++ {
+			if matchWildcard(pattern[1:], s[i:]) {
+				return true
+			}
+		}
+		return false
+	case '?':
+		return s != "" && matchWildcard(pattern[1:], s[1:])
+	default:
+		return s != "" && pattern[0] == s[0] && matchWildcard(pattern[1:], s[1:])
+	}
+}
+
+func expandSSHConfigTokens(value, host, remoteUser string) string {
+	home := ""
+	localUser := ""
+	if u, err := user.Current(); err == nil {
+		home = u.HomeDir
+		localUser = u.Username
+	}
+
+	r := strings.NewReplacer("%%", "%", "%d", home, "%h", host, "%r", remoteUser, "%u", localUser)
+	value = r.Replace(value)
+	if resolved, err := ResolveUserHome(value); err == nil {
+		value = resolved
+	}
+
+	return value
+}
+
+// ParseProxyJump parses ProxyJump value "[user@]host[:port],..." to jump configs.
+// "none" is no jump.
+func ParseProxyJump(value string) ([]JumpConfig, error) {
+	if value == "" || strings.EqualFold(value, "none") {
+		return nil, nil
+	}
+
+	jumps := make([]JumpConfig, 0)
+	for _, j := range strings.Split(value, ",") {
+		j = strings.TrimPrefix(strings.TrimSpace(j), "ssh://")
+		jc := JumpConfig{}
+		if i := strings.LastIndex(j, "@"); i >= 0 {
+			jc.User = j[:i]
+			j = j[i+1:]
+		}
+
+		jc.Host = j
+		if i := strings.LastIndex(j, ":"); i >= 0 && !strings.HasSuffix(j, "]") {
+			port, err := strconv.Atoi(j[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid ProxyJump port %s", j)
+			}
+			jc.Host = j[:i]
+			jc.Port = port
+		}
+		jc.Host = strings.Trim(jc.Host, "[]")
+
+		if jc.Host == "" {
+			return nil, fmt.Errorf("invalid ProxyJump %s", value)
+		}
+		jumps = append(jumps, jc)
+	}
+
+	return jumps, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeSSHConfig(t *testing.T, path, content string) {
+	t.Helper()
+
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMatchSSHHostPatterns(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		host     string
+		want     bool
+	}{
+		{[]string{"bastion"}, "bastion", true},
+		{[]string{"bastion"}, "bastion2", false},
+		{[]string{"*"}, "anything", true},
+		{[]string{"*.example.com"}, "db.example.com", true},
+		{[]string{"*.example.com"}, "example.com", false},
+		{[]string{"db?"}, "db1", true},
+		{[]string{"db?"}, "db12", false},
+		{[]string{"a", "b"}, "b", true},
+		{[]string{"a,b"}, "b", true},
+		{[]string{"*.example.com", "!bad.example.com"}, "bad.example.com", false},
+		{[]string{"!bad.example.com", "*.example.com"}, "bad.example.com", false},
+		{[]string{"*.example.com", "!bad.example.com"}, "good.example.com", true},
+		// only negation never matches.
+		{[]string{"!bad"}, "good", false},
+	}
+
+	for _, tt := range tests {
+		got := matchSSHHostPatterns(tt.patterns, tt.host)
+		if got != tt.want {
+			t.Errorf("matchSSHHostPatterns(%v, %s) = %v, want %v", tt.patterns, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestSSHConfigLookup(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config")
+	writeSSHConfig(t, path, `# global
+ServerAliveInterval 30
+
+Host bastion
+  HostName bastion.example.com
+  User alice
+  Port=2222
+  IdentityFile "/keys/%h/%r/id_ed25519"
+  ProxyJump jump.example.com
+
+Host *.internal !secret.internal
+  HostName %h.example.com
+  User bob
+  ServerAliveCountMax 5
+
+Host *
+  User default
+  Port 22
+  ServerAliveInterval 60
+`)
+
+	c, err := loadSSHConfig(path, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	localUser := ""
+	if u, err := user.Current(); err == nil {
+		localUser = u.Username
+	}
+
+	tests := []struct {
+		host string
+		want SSHConfigHost
+	}{
+		{
+			host: "bastion",
+			want: SSHConfigHost{
+				HostName:            "bastion.example.com",
+				User:                "alice",
+				Port:                2222,
+				IdentityFile:        "/keys/bastion/alice/id_ed25519",
+				ProxyJump:           "jump.example.com",
+				ServerAliveInterval: 30,
+			},
+		},
+		{
+			host: "db.internal",
+			want: SSHConfigHost{
+				HostName:            "db.internal.example.com",
+				User:                "bob",
+				Port:                22,
+				ServerAliveInterval: 30,
+				ServerAliveCountMax: 5,
+			},
+		},
+		{
+			// negated host falls through to Host *
+			host: "secret.internal",
+			want: SSHConfigHost{
+				User:                "default",
+				Port:                22,
+				ServerAliveInterval: 30,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		got := c.Lookup(tt.host)
+		if got != tt.want {
+			t.Errorf("Lookup(%s) = %+v, want %+v", tt.host, got, tt.want)
+		}
+	}
+
+	// %r is local user when User is not specified.
+	writeSSHConfig(t, path, "Host nouser\n  IdentityFile /keys/%r/%h%%\n")
+	c, err = loadSSHConfig(path, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.Lookup("nouser").IdentityFile, "/keys/"+localUser+"/nouser%"; got != want {
+		t.Errorf("IdentityFile = %s, want %s", got, want)
+	}
+}
+
+func TestSSHConfigInclude(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config")
+	writeSSHConfig(t, path, `Include conf.d/*.conf
+
+Host bastion
+  Include bastion/extra
+  User main
+`)
+	// relative Include is in ssh dir.
+	writeSSHConfig(t, filepath.Join(dir, "conf.d", "a.conf"), "Host bastion\n  HostName a.example.com\n")
+	writeSSHConfig(t, filepath.Join(dir, "conf.d", "b.conf"), "Host bastion\n  HostName b.example.com\n  Port 2022\n")
+	writeSSHConfig(t, filepath.Join(dir, "conf.d", "ignored.txt"), "Host bastion\n  User ignored\n")
+	// Include in Host block is only for the host.
+	writeSSHConfig(t, filepath.Join(dir, "bastion", "extra"), "User extra\nServerAliveInterval 15\n")
+
+	c, err := loadSSHConfig(path, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := SSHConfigHost{
+		// first obtained value is used, files are in glob order.
+		HostName:            "a.example.com",
+		User:                "extra",
+		Port:                2022,
+		ServerAliveInterval: 15,
+	}
+	if got := c.Lookup("bastion"); got != want {
+		t.Errorf("Lookup(bastion) = %+v, want %+v", got, want)
+	}
+
+	if got := c.Lookup("other"); got != (SSHConfigHost{}) {
+		t.Errorf("Lookup(other) = %+v, want empty", got)
+	}
+}
+
+func TestSSHConfigIncludeLoop(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config")
+	writeSSHConfig(t, path, "Include config\n")
+
+	_, err := loadSSHConfig(path, dir)
+	if err == nil || !strings.Contains(err.Error(), "too deep Include") {
+		t.Errorf("got error %v, want too deep Include", err)
+	}
+}
+
+func TestParseProxyJump(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []JumpConfig
+		wantErr bool
+	}{
+		{value: "", want: nil},
+		{value: "none", want: nil},
+		{value: "jump", want: []JumpConfig{{Host: "jump"}}},
+		{value: "alice@jump:2222", want: []JumpConfig{{Host: "jump", Port: 2222, User: "alice"}}},
+		{value: "ssh://alice@jump:2222", want: []JumpConfig{{Host: "jump", Port: 2222, User: "alice"}}},
+		{
+			value: "a@j1, j2:22",
+			want:  []JumpConfig{{Host: "j1", User: "a"}, {Host: "j2", Port: 22}},
+		},
+		{value: "[2001:db8::1]:2222", want: []JumpConfig{{Host: "2001:db8::1", Port: 2222}}},
+		{value: "alice@[2001:db8::1]", want: []JumpConfig{{Host: "2001:db8::1", User: "alice"}}},
+		{value: "jump:port", wantErr: true},
+		{value: "alice@", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseProxyJump(tt.value)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseProxyJump(%q) = %+v, want error", tt.value, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("ParseProxyJump(%q) error: %v", tt.value, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseProxyJump(%q) = %+v, want %+v", tt.value, got, tt.want)
+		}
+	}
+}
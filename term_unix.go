@@ -0,0 +1,27 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// inForegroundProcessGroup returns true if mogura is in foreground process group of the controlling terminal.
+// then the signal from terminal (Ctrl+C) is sent to the group, and the command in same group got it too.
+func inForegroundProcessGroup() bool {
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		// no controlling terminal
+		return false
+	}
+	defer tty.Close()
+
+	pgrp, err := unix.IoctlGetInt(int(tty.Fd()), unix.TIOCGPGRP)
+	if err != nil {
+		return false
+	}
+
+	return pgrp == unix.Getpgrp()
+}
@@ -0,0 +1,6 @@
+package main
+
+// inForegroundProcessGroup always returns false on windows, signals are always passed to the command.
+func inForegroundProcessGroup() bool {
+	return false
+}